@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+)
+
+// ipPolicy controls how much of the client ip is shared with a provider
+type ipPolicy string
+
+const (
+	ipPolicyFull      ipPolicy = "full"
+	ipPolicyTruncated ipPolicy = "truncated"
+	// ipPolicyCountry replaces the ip with a configured ip of the same
+	// country, falling back to truncation for countries without one
+	ipPolicyCountry ipPolicy = "country"
+)
+
+func (p *adProviders) anonymizeIp(ip string, policy ipPolicy) string {
+	switch policy {
+	case ipPolicyFull:
+		return ip
+	case ipPolicyCountry:
+		if countryIp, ok := p.countryIps[getCountryCodeByIP(ip)]; ok {
+			return countryIp
+		}
+	}
+	return truncateIp(ip)
+}
+
+// ipAddress is the client ip that can be shared with the provider. Every
+// request to a provider must use it instead of getIpAddress.
+func (p *adProviders) ipAddress(r *http.Request, provider string) string {
+	policy, ok := p.ipPolicies[provider]
+	if !ok {
+		policy = ipPolicyTruncated
+	}
+	// Users who didn't consent to personalization never share their full ip
+	if policy == ipPolicyFull && !consentFromContext(r.Context()).Personalized {
+		policy = ipPolicyTruncated
+	}
+	return p.anonymizeIp(getIpAddress(r), policy)
+}
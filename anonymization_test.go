@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var originalFetchEthicalAds = fetchEthicalAds
+
+// providersWithIpPolicy returns the providers of the test config with the
+// same ip policy for all of them
+func providersWithIpPolicy(policy ipPolicy) *adProviders {
+	providers := newAdProviders(testConfig.Providers)
+	providers.ipPolicies = map[string]ipPolicy{
+		hystrixBsa:     policy,
+		hystrixEa:      policy,
+		hystrixOpenRTB: policy,
+	}
+	return providers
+}
+
+func TestAnonymizeIp(t *testing.T) {
+	providers := newAdProviders(ProvidersConfig{CountryIps: map[string]string{"usa": "198.51.100.1"}})
+	originalCountry := getCountryCodeByIP
+	getCountryCodeByIP = func(ip string) string {
+		if ip == "208.98.185.89" {
+			return "USA"
+		}
+		return "DEU"
+	}
+	defer func() {
+		getCountryCodeByIP = originalCountry
+	}()
+
+	assert.Equal(t, "208.98.185.89", providers.anonymizeIp("208.98.185.89", ipPolicyFull))
+	assert.Equal(t, "208.98.185.0", providers.anonymizeIp("208.98.185.89", ipPolicyTruncated))
+	assert.Equal(t, "2001:db8:85a3::", providers.anonymizeIp("2001:db8:85a3:8d3:1319:8a2e:370:7348", ipPolicyTruncated))
+	assert.Equal(t, "198.51.100.1", providers.anonymizeIp("208.98.185.89", ipPolicyCountry))
+	assert.Equal(t, "85.214.132.0", providers.anonymizeIp("85.214.132.117", ipPolicyCountry), "countries without an ip should be truncated")
+}
+
+func TestProviderIpAddress(t *testing.T) {
+	providers := providersWithIpPolicy(ipPolicyFull)
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	req.Header.Set("x-forwarded-for", "208.98.185.89")
+
+	assert.Equal(t, "208.98.185.89", providers.ipAddress(req, hystrixBsa))
+	assert.Equal(t, "208.98.185.0", providers.ipAddress(req, "unknown"), "unknown providers should get a truncated ip")
+
+	req.Header.Set("Sec-GPC", "1")
+	assert.Equal(t, "208.98.185.0", providers.ipAddress(withConsent(req), hystrixBsa), "non-personalized requests should never share the full ip")
+}
+
+func TestNoFullIpSentToProviders(t *testing.T) {
+	providers := providersWithIpPolicy(ipPolicyTruncated)
+	originalClient := httpClient
+	var sent []string
+	httpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		payload := req.URL.String()
+		if req.Body != nil {
+			body, _ := io.ReadAll(req.Body)
+			payload += " " + string(body)
+		}
+		sent = append(sent, payload)
+		return &http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})}
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	defer func() {
+		httpClient = originalClient
+	}()
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	req.Header.Set("x-forwarded-for", "208.98.185.89")
+
+	_, _ = originalFetchBsa(providers, req, "CEBI62J7")
+	_, _ = originalFetchEthicalAds(providers, req, []string{"webdev"})
+	bidReq, err := json.Marshal(buildOpenRTBRequest(providers, req, "id", nil))
+	assert.Nil(t, err)
+	sent = append(sent, string(bidReq))
+
+	assert.Len(t, sent, 3)
+	for _, payload := range sent {
+		assert.NotContains(t, payload, "208.98.185.89")
+		assert.Contains(t, payload, "208.98.185.0")
+	}
+}
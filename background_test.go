@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEmulatorClient returns a client of the local Pub/Sub emulator, the tests
+// are skipped when PUBSUB_EMULATOR_HOST is not set
+func newEmulatorClient(t *testing.T) *pubsub.Client {
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST is not set")
+	}
+
+	client, err := pubsub.NewClient(context.Background(), "test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+// createSubscription creates a topic and a subscription with the same name,
+// provisioned with the retry policy of the consumer options
+func createSubscription(t *testing.T, client *pubsub.Client, name string) *pubsub.Topic {
+	ctx := context.Background()
+	topic, err := client.CreateTopic(ctx, name)
+	require.NoError(t, err)
+	sub, err := client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{
+		Topic:       topic,
+		AckDeadline: time.Second * 10,
+		RetryPolicy: &pubsub.RetryPolicy{MinimumBackoff: testConfig.Consumer.MinBackoff, MaximumBackoff: testConfig.Consumer.MaxBackoff},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = sub.Delete(ctx)
+		topic.Stop()
+		_ = topic.Delete(ctx)
+	})
+	return topic
+}
+
+func publish(t *testing.T, topic *pubsub.Topic, data interface{}) {
+	js, err := json.Marshal(data)
+	require.NoError(t, err)
+	_, err = topic.Publish(context.Background(), &pubsub.Message{Data: js}).Get(context.Background())
+	require.NoError(t, err)
+}
+
+func countRows(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	var count int
+	require.NoError(t, db.QueryRow(query, args...).Scan(&count))
+	return count
+}
+
+func TestBackgroundApp(t *testing.T) {
+	client := newEmulatorClient(t)
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	topics := make(map[string]*pubsub.Topic)
+	for _, name := range []string{
+		"monetization-new-ad",
+		"monetization-views",
+		"monetization-user-created",
+		"monetization-user-updated",
+		"monetization-user-deleted",
+		"monetization-delete-old-tags",
+		"monetization-profile-invalidations",
+	} {
+		topics[name] = createSubscription(t, client, name)
+	}
+
+	_, err := db.Exec("INSERT INTO user_tags (user_id, tag, last_read) VALUES ('old', 'webdev', '2021-01-12 08:54:07'), ('3', 'webdev', now())")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('3', 'MORE_THAN_4_YEARS')")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- createBackgroundApp(ctx, testConfig, newStores(store), client)
+	}()
+
+	newAd := camp
+	newAd.Link = "https://link.com"
+	newAd.Image = "https://media.daily.dev/image.png"
+	publish(t, topics["monetization-new-ad"], ScheduledCampaignAd{
+		CampaignAd: newAd,
+		Start:      time.Now().Add(time.Hour * -1),
+		End:        time.Now().Add(time.Hour),
+	})
+	publish(t, topics["monetization-views"], ViewMessage{UserId: "1", Tags: []string{"go", "rust"}})
+	publish(t, topics["monetization-user-created"], UserCreatedMessage{User: user{Id: "1", ExperienceLevel: "MORE_THAN_2_YEARS"}})
+	publish(t, topics["monetization-user-updated"], UserUpdatedMessage{NewProfile: user{Id: "2", ExperienceLevel: "MORE_THAN_6_YEARS"}})
+	publish(t, topics["monetization-user-deleted"], UserDeletedMessage{UserId: "3"})
+	publish(t, topics["monetization-delete-old-tags"], struct{}{})
+
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM ads WHERE id = ?", camp.Id) == 1
+	}, time.Second*10, time.Millisecond*100, "new ad was not added")
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM user_tags WHERE user_id = '1'") == 2
+	}, time.Second*10, time.Millisecond*100, "view tags were not added")
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM user_experience_levels WHERE user_id = '1' AND experience_level = 'MORE_THAN_2_YEARS'") == 1
+	}, time.Second*10, time.Millisecond*100, "created user experience level was not set")
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM user_experience_levels WHERE user_id = '2' AND experience_level = 'MORE_THAN_6_YEARS'") == 1
+	}, time.Second*10, time.Millisecond*100, "updated user experience level was not set")
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM user_experience_levels WHERE user_id = '3'") == 0 &&
+			countRows(t, db, "SELECT count(*) FROM user_tags WHERE user_id = '3'") == 0
+	}, time.Second*10, time.Millisecond*100, "deleted user data was not erased")
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM user_tags WHERE user_id = 'old'") == 0
+	}, time.Second*10, time.Millisecond*100, "old tags were not deleted")
+
+	invalidated := make(chan string, 10)
+	receiveCtx, stopReceiving := context.WithCancel(context.Background())
+	defer stopReceiving()
+	go func() {
+		_ = client.Subscription("monetization-profile-invalidations").Receive(receiveCtx, func(ctx context.Context, msg *pubsub.Message) {
+			var data ProfileInvalidationMessage
+			if json.Unmarshal(msg.Data, &data) == nil {
+				for _, userId := range data.UserIds {
+					invalidated <- userId
+				}
+			}
+			msg.Ack()
+		})
+	}()
+	var userIds []string
+	assert.Eventually(t, func() bool {
+		for {
+			select {
+			case userId := <-invalidated:
+				userIds = append(userIds, userId)
+			default:
+				return len(userIds) == 4
+			}
+		}
+	}, time.Second*10, time.Millisecond*100, "profiles were not invalidated")
+	assert.ElementsMatch(t, []string{"1", "1", "2", "3"}, userIds)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestConsumerRedeliversFailedMessages(t *testing.T) {
+	client := newEmulatorClient(t)
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	topic := createSubscription(t, client, "test-redelivery")
+	var attempts int32
+	view := newViewHandler(newTagBatcher(1, time.Millisecond, store.AddOrUpdateUsersTags))
+	c := newConsumer(client, "test-redelivery", testConfig.Consumer, func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return errors.New("error")
+		}
+		return view(ctx, log, data)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.run(ctx)
+	}()
+
+	publish(t, topic, ViewMessage{UserId: "1", Tags: []string{"go"}})
+	assert.Eventually(t, func() bool {
+		return countRows(t, db, "SELECT count(*) FROM user_tags WHERE user_id = '1'") == 1
+	}, time.Second*20, time.Millisecond*100, "message was not redelivered")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+
+	cancel()
+	assert.Nil(t, <-done)
+}
@@ -21,15 +21,17 @@ type BsaResponse struct {
 
 var hystrixBsa = "BSA"
 
-func sendBsaRequest(r *http.Request, propertyId string) (BsaResponse, error) {
+const bsaSegment = "placement:dailynowco"
+
+func sendBsaRequest(p *adProviders, r *http.Request, propertyId string) (BsaResponse, error) {
 	var res BsaResponse
 	ua := r.UserAgent()
-	ip := getIpAddress(r)
+	ip := p.ipAddress(r, hystrixBsa)
 	//ip = "208.98.185.89"
-	req, _ := http.NewRequest("GET", "https://srv.buysellads.com/ads/"+propertyId+".json?segment=placement:dailynowco&forwardedip="+ip+"&useragent="+url.QueryEscape(ua), nil)
+	req, _ := http.NewRequest("GET", "https://srv.buysellads.com/ads/"+propertyId+".json?segment="+bsaSegment+"&forwardedip="+ip+"&useragent="+url.QueryEscape(ua), nil)
 	req = req.WithContext(r.Context())
 
-	err := getJsonHystrix(hystrixBsa, req, &res, false)
+	err := getJsonHystrix(providerBreaker(hystrixBsa, propertyId), req, &res, false)
 	if err != nil {
 		return BsaResponse{}, err
 	}
@@ -37,9 +39,15 @@ func sendBsaRequest(r *http.Request, propertyId string) (BsaResponse, error) {
 	return res, nil
 }
 
-var fetchBsa = func(r *http.Request, propertyId string) (*BsaAd, error) {
-	res, err := sendBsaRequest(r, propertyId)
+var fetchBsa = func(p *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
+	key := providerCacheKey(hystrixBsa, propertyId, getCountryByIP(getIpAddress(r)), bsaSegment)
+	if cached, ok := p.lookupNoFill(r.Context(), hystrixBsa, key); ok {
+		return nil, cached.err
+	}
+
+	res, err := sendBsaRequest(p, r, propertyId)
 	if err != nil {
+		p.rememberNoFill(key, err)
 		return nil, err
 	}
 
@@ -81,5 +89,6 @@ var fetchBsa = func(r *http.Request, propertyId string) (*BsaAd, error) {
 		}
 	}
 
+	p.rememberNoFill(key, nil)
 	return nil, nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ttlCache is a minimal concurrency safe cache of values that expire after a
+// fixed duration. A zero ttl disables the cache.
+type ttlCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	entries map[string]cacheEntry
+}
+
+func newTtlCache(ttl time.Duration, maxSize int) *ttlCache {
+	return &ttlCache{ttl: ttl, maxSize: maxSize, entries: make(map[string]cacheEntry)}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.maxSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	// Still full of live entries, better to skip than to grow unbounded
+	if len(c.entries) >= c.maxSize {
+		return
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+func (c *ttlCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]cacheEntry)
+}
+
+// noFill is cached when a provider has nothing to serve or failed
+type noFill struct {
+	err error
+}
+
+// newProviderCache remembers for a few seconds which provider properties have
+// no inventory for a country and segment, so they aren't called on every
+// request
+func newProviderCache(ttl time.Duration) *ttlCache {
+	return newTtlCache(ttl, 10000)
+}
+
+func providerCacheKey(provider string, property string, country string, segment string) string {
+	return strings.Join([]string{provider, property, country, segment}, "|")
+}
+
+// lookupNoFill returns the cached no-fill of the key and records whether it
+// was a hit or a miss
+func (p *adProviders) lookupNoFill(ctx context.Context, provider string, key string) (noFill, bool) {
+	if value, ok := p.cache.get(key); ok {
+		recordProviderMetric(ctx, provider, providerCacheHits)
+		return value.(noFill), true
+	}
+	recordProviderMetric(ctx, provider, providerCacheMisses)
+	return noFill{}, false
+}
+
+func (p *adProviders) rememberNoFill(key string, err error) {
+	// A cancelled request says nothing about the provider's inventory
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	p.cache.set(key, noFill{err: err})
+}
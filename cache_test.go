@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var originalFetchBsa = fetchBsa
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTtlCache(t *testing.T) {
+	cache := newTtlCache(time.Millisecond*50, 2)
+	cache.set("a", 1)
+	cache.set("b", 2)
+	cache.set("c", 3)
+
+	value, ok := cache.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	_, ok = cache.get("c")
+	assert.False(t, ok, "cache should not grow over its max size")
+
+	time.Sleep(time.Millisecond * 60)
+	_, ok = cache.get("a")
+	assert.False(t, ok, "entry should expire")
+	cache.set("c", 3)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+}
+
+func TestDisabledTtlCache(t *testing.T) {
+	cache := newTtlCache(0, 10)
+	cache.set("a", 1)
+	_, ok := cache.get("a")
+	assert.False(t, ok)
+}
+
+func TestBsaNoFillCached(t *testing.T) {
+	providers := newAdProviders(testConfig.Providers)
+	originalClient := httpClient
+	calls := 0
+	httpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"ads":[{}]}`))}, nil
+	})}
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	defer func() {
+		httpClient = originalClient
+	}()
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		bsa, err := originalFetchBsa(providers, req, "CACHED")
+		assert.Nil(t, err)
+		assert.Nil(t, bsa)
+	}
+	assert.Equal(t, 1, calls)
+
+	_, err = originalFetchBsa(providers, req, "OTHER")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+}
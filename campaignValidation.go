@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// probabilityTolerance absorbs the rounding of the float32 probabilities, so
+// campaigns that add up to exactly 1 are accepted
+const probabilityTolerance = 1e-6
+
+func isHttpsUrl(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// validateCampaign checks a new campaign before it's added and returns a
+// rejectionError with every problem it found. Campaigns also must not push
+// the total probability of the campaigns they compete with over 1, or the
+// selection of ServeAd would never reach some of them.
+func validateCampaign(ctx context.Context, camp ScheduledCampaignAd, campaigns CampaignStore) error {
+	var reasons []rejectionReason
+	reject := func(field string, format string, args ...interface{}) {
+		reasons = append(reasons, rejectionReason{Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(camp.Id) == "" {
+		reject("id", "is required")
+	}
+	if strings.TrimSpace(camp.Description) == "" {
+		reject("description", "is required")
+	}
+	if !isHttpsUrl(camp.Link) {
+		reject("link", "%q is not an https url", camp.Link)
+	}
+	if !isHttpsUrl(camp.Image) {
+		reject("image", "%q is not an https url", camp.Image)
+	}
+	if !camp.Start.Before(camp.End) {
+		reject("end", "must be after start")
+	}
+	if camp.Probability < 0 || camp.Probability > 1 {
+		reject("probability", "must be between 0 and 1, got %v", camp.Probability)
+	}
+	for _, level := range camp.ExperienceLevels {
+		if !isValidExperienceLevel(level) {
+			reject("experienceLevels", "%q is not an experience level", level)
+		}
+	}
+	if err := validateExperienceRange(camp.MinExperienceLevel, camp.MaxExperienceLevel); err != nil {
+		reject("experienceRange", "%q to %q is not a range of the experience scale", camp.MinExperienceLevel, camp.MaxExperienceLevel)
+	}
+	if len(reasons) > 0 {
+		return &rejectionError{Reasons: reasons}
+	}
+
+	// Failing to load the other campaigns is not the campaign's fault, so
+	// the error is returned as is to retry the message
+	others, err := campaigns.FetchOverlappingCampaigns(ctx, camp.Start, camp.End)
+	if err != nil {
+		return err
+	}
+	if country, total := maxCompetingProbability(camp, others); total > 1+probabilityTolerance {
+		if country == "" {
+			reject("probability", "campaigns without a geo would add up to %.2f", total)
+		} else {
+			reject("probability", "campaigns served in %q would add up to %.2f", country, total)
+		}
+		return &rejectionError{Reasons: reasons}
+	}
+	return nil
+}
+
+// competingCountries lists the countries named by the geos of the campaigns,
+// along with "" for the countries none of them names, where only the
+// campaigns without a geo are served
+func competingCountries(camps []ScheduledCampaignAd) []string {
+	seen := map[string]bool{"": true}
+	countries := []string{""}
+	for _, camp := range camps {
+		for _, country := range strings.Split(camp.Geo, ",") {
+			country = strings.TrimSpace(country)
+			if !seen[country] {
+				seen[country] = true
+				countries = append(countries, country)
+			}
+		}
+	}
+	return countries
+}
+
+// servedInCountry matches the campaign like ServeAd does, "" stands for the
+// countries no geo names
+func servedInCountry(camp ScheduledCampaignAd, country string) bool {
+	if country == "" {
+		return camp.Geo == ""
+	}
+	return camp.servedIn(country)
+}
+
+// competes tells whether both campaigns are considered for the same requests
+// of the country, which happens when they're of the same kind, fallback or
+// not, and are both served in the country
+func competes(camp ScheduledCampaignAd, other ScheduledCampaignAd, country string) bool {
+	return other.Id != camp.Id && other.Fallback == camp.Fallback && servedInCountry(other, country)
+}
+
+// maxCompetingProbability returns the country and the highest total
+// probability of the campaign along with the ones it competes with at any
+// time of its schedule. Campaigns are matched to the countries like ServeAd
+// does, so a campaign without a geo competes in every country.
+func maxCompetingProbability(camp ScheduledCampaignAd, others []ScheduledCampaignAd) (string, float64) {
+	var countries []string
+	for _, country := range competingCountries(append([]ScheduledCampaignAd{camp}, others...)) {
+		if servedInCountry(camp, country) {
+			countries = append(countries, country)
+		}
+	}
+
+	// The total grows only when a campaign starts, so it peaks at the start
+	// of the campaign or of one that starts during its schedule
+	instants := []time.Time{camp.Start}
+	for _, other := range others {
+		if other.Start.After(camp.Start) && other.Start.Before(camp.End) {
+			instants = append(instants, other.Start)
+		}
+	}
+
+	var maxCountry string
+	var maxTotal float64
+	for _, country := range countries {
+		for _, instant := range instants {
+			total := float64(camp.Probability)
+			for _, other := range others {
+				if competes(camp, other, country) && !other.Start.After(instant) && other.End.After(instant) {
+					total += float64(other.Probability)
+				}
+			}
+			if total > maxTotal {
+				maxCountry, maxTotal = country, total
+			}
+		}
+	}
+	return maxCountry, maxTotal
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validCampaign(id string) ScheduledCampaignAd {
+	camp := scheduledCampaign(id)
+	camp.Link = "https://daily.dev"
+	camp.Image = "https://media.daily.dev/image.png"
+	camp.Probability = 0.5
+	return camp
+}
+
+func TestValidateCampaign(t *testing.T) {
+	campaigns := newMemoryStore()
+	require.NoError(t, validateCampaign(context.Background(), validCampaign("1"), campaigns))
+
+	camp := validCampaign("1")
+	camp.Description = " "
+	camp.Link = "http://daily.dev"
+	camp.Image = ""
+	camp.End = camp.Start
+	camp.Probability = 1.5
+	camp.ExperienceLevels = []string{"SENIOR"}
+	camp.MinExperienceLevel = "MORE_THAN_6_YEARS"
+	camp.MaxExperienceLevel = "MORE_THAN_2_YEARS"
+	err := validateCampaign(context.Background(), camp, campaigns)
+
+	var rejection *rejectionError
+	require.ErrorAs(t, err, &rejection)
+	assert.Equal(t, []rejectionReason{
+		{Field: "description", Reason: "is required"},
+		{Field: "link", Reason: `"http://daily.dev" is not an https url`},
+		{Field: "image", Reason: `"" is not an https url`},
+		{Field: "end", Reason: "must be after start"},
+		{Field: "probability", Reason: "must be between 0 and 1, got 1.5"},
+		{Field: "experienceLevels", Reason: `"SENIOR" is not an experience level`},
+		{Field: "experienceRange", Reason: `"MORE_THAN_6_YEARS" to "MORE_THAN_2_YEARS" is not a range of the experience scale`},
+	}, rejection.Reasons)
+}
+
+func TestValidateCampaignProbability(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	campaigns := newMemoryStore()
+	us := validCampaign("us")
+	us.Geo = "united states"
+	us.Probability = 0.6
+	us.Start, us.End = now, now.Add(time.Hour*2)
+	fallback := validCampaign("fallback")
+	fallback.Fallback = true
+	fallback.Probability = 1
+	for _, camp := range []ScheduledCampaignAd{us, fallback} {
+		require.NoError(t, campaigns.AddCampaign(ctx, camp))
+	}
+
+	isRejected := func(camp ScheduledCampaignAd) bool {
+		err := validateCampaign(ctx, camp, campaigns)
+		var rejection *rejectionError
+		if errors.As(err, &rejection) {
+			return true
+		}
+		require.NoError(t, err)
+		return false
+	}
+
+	sameGeo := validCampaign("same")
+	sameGeo.Geo = "united states"
+	assert.True(t, isRejected(sameGeo), "campaigns of the geo should not add up to more than 1")
+	sameGeo.Probability = 0.4
+	assert.False(t, isRejected(sameGeo), "campaigns of the geo may add up to 1")
+
+	multiCountry := validCampaign("multi")
+	multiCountry.Geo = "united states,canada"
+	assert.True(t, isRejected(multiCountry), "campaigns listing the country compete in it")
+	multiCountry.Probability = 0.4
+	assert.False(t, isRejected(multiCountry))
+
+	otherGeo := validCampaign("other")
+	otherGeo.Geo = "germany"
+	assert.False(t, isRejected(otherGeo))
+
+	anyGeo := validCampaign("any")
+	assert.True(t, isRejected(anyGeo), "campaigns without a geo compete in every geo")
+
+	later := validCampaign("later")
+	later.Geo = "united states"
+	later.Start, later.End = now.Add(time.Hour*3), now.Add(time.Hour*4)
+	assert.False(t, isRejected(later), "campaigns that don't overlap don't compete")
+
+	overlapping := validCampaign("overlapping")
+	overlapping.Geo = "united states"
+	overlapping.Start, overlapping.End = now.Add(-time.Hour), now.Add(time.Minute)
+	assert.True(t, isRejected(overlapping), "campaigns compete when their schedules overlap")
+
+	require.NoError(t, campaigns.AddCampaign(ctx, multiCountry))
+	canada := validCampaign("canada")
+	canada.Geo = "canada"
+	canada.Probability = 0.7
+	assert.True(t, isRejected(canada), "campaigns compete with the ones listing their country")
+
+	anotherFallback := validCampaign("another-fallback")
+	anotherFallback.Fallback = true
+	assert.True(t, isRejected(anotherFallback), "fallback campaigns compete with each other")
+}
+
+func TestNewAdRejected(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	workers := &Workers{stores: newStores(store)}
+	camp := validCampaign("1")
+	camp.Description = ""
+
+	err := workers.NewAd(ctx, log.NewEntry(log.StandardLogger()), camp)
+	var rejection *rejectionError
+	require.ErrorAs(t, err, &rejection)
+	res, err := store.FetchOverlappingCampaigns(ctx, camp.Start, camp.End)
+	require.NoError(t, err)
+	assert.Empty(t, res, "invalid campaign should not be added")
+
+	require.NoError(t, workers.NewAd(ctx, log.NewEntry(log.StandardLogger()), validCampaign("1")))
+}
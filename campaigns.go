@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/afex/hystrix-go/hystrix"
@@ -28,85 +28,167 @@ type CampaignAd struct {
 	Geo           string  `json:"-"`
 	IsTagTargeted bool    `json:"-"`
 	IsExpTargeted bool    `json:"-"`
+	Price         float32 `json:"-"`
+	// utm is added to the link when the campaign is served
+	utm UtmTemplate
 }
 
 type ScheduledCampaignAd struct {
 	CampaignAd
 	Start time.Time
 	End   time.Time
+	// Targets the users who read any of the tags and the users with any of
+	// the experience levels. They aren't part of the new-ad messages, the
+	// stores keep them so every implementation targets the same way.
+	Tags             []string `json:"-"`
+	ExperienceLevels []string `json:"-"`
+	// Targets the users whose experience level is within the range, empty
+	// bounds leave it open. Users who are not engineers never match a range.
+	MinExperienceLevel string
+	MaxExperienceLevel string
+	// Utm overrides the UTM parameters of the placements
+	Utm UtmTemplate
 }
 
-var cloudinaryRegex = regexp.MustCompile(`(?:res\.cloudinary\.com\/daily-now|daily-now-res\.cloudinary\.com)`)
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
 
-func mapCloudinaryUrl(url string) string {
-	return cloudinaryRegex.ReplaceAllString(url, "media.daily.dev")
+// servedIn tells whether the campaign is served to the users of the country.
+// The geo of a campaign lists the names of its countries, while the geo of a
+// fallback campaign is a part of the name of the country.
+func (camp CampaignAd) servedIn(country string) bool {
+	if camp.Geo == "" {
+		return true
+	}
+	if camp.Fallback {
+		return strings.Contains(country, camp.Geo)
+	}
+	return strings.Contains(camp.Geo, country)
 }
 
-var addCampaign = func(ctx context.Context, camp ScheduledCampaignAd) error {
+// campaignProviderId tells how the campaign was targeted, fallback campaigns
+// have no provider
+func campaignProviderId(camp CampaignAd) string {
+	if camp.Fallback {
+		return ""
+	}
+	targeted := camp.IsTagTargeted || camp.IsExpTargeted
+	switch {
+	case camp.Geo != "" && targeted:
+		return "direct-combined"
+	case camp.Geo != "":
+		return "direct-geo"
+	case targeted:
+		return "direct-keywords"
+	}
+	return "direct"
+}
+
+func (s *mysqlStore) AddCampaign(ctx context.Context, camp ScheduledCampaignAd) error {
 	return hystrix.DoC(ctx, hystrixDb,
 		func(ctx context.Context) error {
-			_, err := addCampStmt.ExecContext(ctx, camp.Id, camp.Description, camp.Link, camp.Image, camp.Ratio, camp.Placeholder, camp.Source, camp.Company, camp.Probability, camp.Fallback, camp.Geo, camp.Start, camp.End)
+			tx, err := s.db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			_, err = tx.StmtContext(ctx, s.addCampaignStmt).ExecContext(ctx, camp.Id, camp.Description, camp.Link, camp.Image, camp.Ratio, camp.Placeholder, camp.Source, camp.Company, camp.Probability, camp.Fallback, camp.Geo, camp.Start, camp.End,
+				nullString(camp.Utm.Source), nullString(camp.Utm.Medium), nullString(camp.Utm.Campaign), nullString(camp.Utm.Content))
 			if err != nil {
 				return err
 			}
 
-			return nil
+			for _, tag := range camp.Tags {
+				if _, err = tx.ExecContext(ctx, "INSERT INTO ad_tags (ad_id, tag) VALUES (?, ?)", camp.Id, tag); err != nil {
+					return err
+				}
+			}
+			for _, level := range camp.ExperienceLevels {
+				if _, err = tx.ExecContext(ctx, "INSERT INTO ad_experience_level (ad_id, experience_level) VALUES (?, ?)", camp.Id, level); err != nil {
+					return err
+				}
+			}
+			if camp.MinExperienceLevel != "" || camp.MaxExperienceLevel != "" {
+				_, err = tx.ExecContext(ctx, "INSERT INTO ad_experience_range (ad_id, min_experience_level, max_experience_level) VALUES (?, ?, ?)",
+					camp.Id, nullString(camp.MinExperienceLevel), nullString(camp.MaxExperienceLevel))
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.Commit()
 		}, nil)
 }
 
-var fetchCampaigns = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
-	output := make(chan []CampaignAd, 1)
-	errors := hystrix.GoC(ctx, hystrixDb,
+func (s *mysqlStore) FetchCampaigns(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	return readReplicated(ctx, s, func(ctx context.Context, stmts *mysqlReadStmts) ([]CampaignAd, error) {
+		rows, err := stmts.fetchCampaigns.QueryContext(ctx, userId, userId, userId, timestamp, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var res []CampaignAd
+		for rows.Next() {
+			var camp CampaignAd
+			var geo sql.NullString
+			var price sql.NullFloat64
+			var utm [4]sql.NullString
+			err = rows.Scan(&camp.Id, &camp.Description, &camp.Link, &camp.Image, &camp.Ratio, &camp.Placeholder, &camp.Source, &camp.Company, &camp.Probability, &camp.Fallback, &geo, &camp.IsTagTargeted, &camp.IsExpTargeted, &price,
+				&utm[0], &utm[1], &utm[2], &utm[3])
+			if err != nil {
+				return nil, err
+			}
+			camp.utm = UtmTemplate{Source: utm[0].String, Medium: utm[1].String, Campaign: utm[2].String, Content: utm[3].String}
+			camp.Price = float32(price.Float64)
+			camp.Geo = geo.String
+			camp.ProviderId = campaignProviderId(camp)
+			res = append(res, camp)
+		}
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
+}
+
+func (s *mysqlStore) FetchOverlappingCampaigns(ctx context.Context, start time.Time, end time.Time) ([]ScheduledCampaignAd, error) {
+	var res []ScheduledCampaignAd
+	err := hystrix.DoC(ctx, hystrixDb,
 		func(ctx context.Context) error {
-			rows, err := campStmt.QueryContext(ctx, userId, userId, timestamp, timestamp)
+			// Validation must see the campaigns that were just added, so
+			// this always reads from the primary
+			rows, err := s.db.QueryContext(ctx, "select id, probability, fallback, geo, start, end from ads where start < ? and end > ?", end, start)
 			if err != nil {
 				return err
 			}
 			defer rows.Close()
 
-			var res []CampaignAd
+			res = nil
 			for rows.Next() {
-				var camp CampaignAd
+				var camp ScheduledCampaignAd
 				var geo sql.NullString
-				err = rows.Scan(&camp.Id, &camp.Description, &camp.Link, &camp.Image, &camp.Ratio, &camp.Placeholder, &camp.Source, &camp.Company, &camp.Probability, &camp.Fallback, &geo, &camp.IsTagTargeted, &camp.IsExpTargeted)
-				if err != nil {
+				var start, end string
+				if err := rows.Scan(&camp.Id, &camp.Probability, &camp.Fallback, &geo, &start, &end); err != nil {
 					return err
 				}
-				camp.Image = mapCloudinaryUrl(camp.Image)
-				if geo.Valid && len(geo.String) > 0 {
-					camp.Geo = geo.String
-					if !camp.Fallback {
-						if camp.IsTagTargeted || camp.IsExpTargeted {
-							camp.ProviderId = "direct-combined"
-						} else {
-							camp.ProviderId = "direct-geo"
-						}
-					}
-				} else {
-					camp.Geo = ""
-					if !camp.Fallback {
-						if camp.IsTagTargeted || camp.IsExpTargeted {
-							camp.ProviderId = "direct-keywords"
-						} else {
-							camp.ProviderId = "direct"
-						}
-					}
+				// The driver writes and reads the times in UTC
+				if camp.Start, err = time.Parse(time.DateTime, start); err != nil {
+					return err
 				}
+				if camp.End, err = time.Parse(time.DateTime, end); err != nil {
+					return err
+				}
+				camp.Geo = geo.String
 				res = append(res, camp)
 			}
-			err = rows.Err()
-			if err != nil {
-				return err
-			}
-
-			output <- res
-			return nil
+			return rows.Err()
 		}, nil)
-
-	select {
-	case out := <-output:
-		return out, nil
-	case err := <-errors:
+	if err != nil {
 		return nil, err
 	}
+	return res, nil
 }
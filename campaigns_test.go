@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -23,33 +24,29 @@ var camp = CampaignAd{
 }
 
 func TestAddAndFetchCampaigns(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -1),
 		End:        time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"javascript"})
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	assert.Nil(t, err)
 	assert.Equal(t, []CampaignAd{camp}, res)
 }
 
 func TestFetchExpiredCampaigns(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -2),
 		End:        time.Now().Add(time.Hour * -1),
@@ -57,24 +54,22 @@ func TestFetchExpiredCampaigns(t *testing.T) {
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	assert.Nil(t, err)
 	assert.Equal(t, []CampaignAd(nil), res)
 }
 
 func TestFetchCampaignsWithTags(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -1),
 		End:        time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addCampaign(context.Background(), ScheduledCampaignAd{
+	err = store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: CampaignAd{
 			Placeholder: "placholder",
 			Ratio:       0.5,
@@ -93,13 +88,13 @@ func TestFetchCampaignsWithTags(t *testing.T) {
 		End:   time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"javascript"})
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_tags (ad_id, tag) values ('id', ?), ('id2', ?)", "javascript", "php")
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	dup := camp
 	dup.IsTagTargeted = true
 	assert.Nil(t, err)
@@ -107,18 +102,16 @@ func TestFetchCampaignsWithTags(t *testing.T) {
 }
 
 func TestFetchCampaignsWithBoth(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -1),
 		End:        time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addCampaign(context.Background(), ScheduledCampaignAd{
+	err = store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: CampaignAd{
 			Placeholder: "placholder",
 			Ratio:       0.5,
@@ -137,13 +130,13 @@ func TestFetchCampaignsWithBoth(t *testing.T) {
 		End:   time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = setOrUpdateExperienceLevel(context.Background(), "1", "MORE_THAN_4_YEARS")
+	err = store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_4_YEARS")
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_experience_level (ad_id, experience_level) values ('id', ?), ('id2', ?)", "MORE_THAN_4_YEARS", "MORE_THAN_6_YEARS")
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	dup := camp
 	dup.IsExpTargeted = true
 	assert.Nil(t, err)
@@ -151,18 +144,16 @@ func TestFetchCampaignsWithBoth(t *testing.T) {
 }
 
 func TestFetchCampaignsWithExperience(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -1),
 		End:        time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addCampaign(context.Background(), ScheduledCampaignAd{
+	err = store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: CampaignAd{
 			Placeholder: "placholder",
 			Ratio:       0.5,
@@ -181,17 +172,17 @@ func TestFetchCampaignsWithExperience(t *testing.T) {
 		End:   time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"javascript"})
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_tags (ad_id, tag) values ('id', ?), ('id2', ?)", "javascript", "php")
 	assert.Nil(t, err)
-	err = setOrUpdateExperienceLevel(context.Background(), "1", "MORE_THAN_4_YEARS")
+	err = store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_4_YEARS")
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_experience_level (ad_id, experience_level) values ('id', ?), ('id2', ?)", "MORE_THAN_4_YEARS", "MORE_THAN_6_YEARS")
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	dup := camp
 	dup.IsExpTargeted = true
 	dup.IsTagTargeted = true
@@ -200,18 +191,16 @@ func TestFetchCampaignsWithExperience(t *testing.T) {
 }
 
 func TestFetchCampaignsWithExperienceButNotMatching(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -1),
 		End:        time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addCampaign(context.Background(), ScheduledCampaignAd{
+	err = store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: CampaignAd{
 			Placeholder: "placholder",
 			Ratio:       0.5,
@@ -230,34 +219,32 @@ func TestFetchCampaignsWithExperienceButNotMatching(t *testing.T) {
 		End:   time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"javascript"})
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_tags (ad_id, tag) values ('id', ?), ('id2', ?)", "javascript", "php")
 	assert.Nil(t, err)
-	err = setOrUpdateExperienceLevel(context.Background(), "1", "MORE_THAN_6_YEARS")
+	err = store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_6_YEARS")
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_experience_level (ad_id, experience_level) values ('id', ?)", "MORE_THAN_4_YEARS")
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	assert.Nil(t, err)
 	assert.Equal(t, []CampaignAd(nil), res)
 }
 
 func TestFetchCampaignsWithExperienceButMissing(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 
-	err := addCampaign(context.Background(), ScheduledCampaignAd{
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: camp,
 		Start:      time.Now().Add(time.Hour * -1),
 		End:        time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addCampaign(context.Background(), ScheduledCampaignAd{
+	err = store.AddCampaign(context.Background(), ScheduledCampaignAd{
 		CampaignAd: CampaignAd{
 			Placeholder: "placholder",
 			Ratio:       0.5,
@@ -276,18 +263,90 @@ func TestFetchCampaignsWithExperienceButMissing(t *testing.T) {
 		End:   time.Now().Add(time.Hour),
 	})
 	assert.Nil(t, err)
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"javascript"})
 	assert.Nil(t, err)
 	_, err = db.Exec("insert into ad_tags (ad_id, tag) values ('id', ?), ('id2', ?)", "javascript", "php")
 	assert.Nil(t, err)
-	err = setOrUpdateExperienceLevel(context.Background(), "1", "MORE_THAN_6_YEARS")
+	err = store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_6_YEARS")
 	assert.Nil(t, err)
 
 	var res []CampaignAd
-	res, err = fetchCampaigns(context.Background(), time.Now(), "1")
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "1")
 	dup := camp
 	dup.IsExpTargeted = false
 	dup.IsTagTargeted = true
 	assert.Nil(t, err)
 	assert.Equal(t, []CampaignAd{dup}, res)
 }
+
+func TestFetchCampaignsWithExperienceRange(t *testing.T) {
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
+		CampaignAd:         camp,
+		Start:              time.Now().Add(time.Hour * -1),
+		End:                time.Now().Add(time.Hour),
+		MinExperienceLevel: "MORE_THAN_2_YEARS",
+		MaxExperienceLevel: "MORE_THAN_6_YEARS",
+	})
+	assert.Nil(t, err)
+	levels := map[string]string{
+		"1": "MORE_THAN_2_YEARS",
+		"2": "MORE_THAN_6_YEARS",
+		"3": "MORE_THAN_10_YEARS",
+		"4": "LESS_THAN_1_YEAR",
+		"5": "NOT_ENGINEER",
+	}
+	for userId, level := range levels {
+		assert.Nil(t, store.SetExperienceLevel(context.Background(), userId, level))
+	}
+
+	dup := camp
+	dup.IsExpTargeted = true
+	for _, userId := range []string{"1", "2"} {
+		res, err := store.FetchCampaigns(context.Background(), time.Now(), userId)
+		assert.Nil(t, err)
+		assert.Equal(t, []CampaignAd{dup}, res, userId)
+	}
+	for _, userId := range []string{"3", "4", "5", "6"} {
+		res, err := store.FetchCampaigns(context.Background(), time.Now(), userId)
+		assert.Nil(t, err)
+		assert.Equal(t, []CampaignAd(nil), res, userId)
+	}
+}
+
+func TestFetchCampaignsWithOpenExperienceRange(t *testing.T) {
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	err := store.AddCampaign(context.Background(), ScheduledCampaignAd{
+		CampaignAd:         camp,
+		Start:              time.Now().Add(time.Hour * -1),
+		End:                time.Now().Add(time.Hour),
+		MinExperienceLevel: "LESS_THAN_1_YEAR",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_10_YEARS"))
+	assert.Nil(t, store.SetExperienceLevel(context.Background(), "2", "NOT_ENGINEER"))
+
+	dup := camp
+	dup.IsExpTargeted = true
+	res, err := store.FetchCampaigns(context.Background(), time.Now(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, []CampaignAd{dup}, res)
+
+	res, err = store.FetchCampaigns(context.Background(), time.Now(), "2")
+	assert.Nil(t, err)
+	assert.Equal(t, []CampaignAd(nil), res, "not engineers should be excluded")
+}
+
+func TestNewAdMessageIgnoresTargeting(t *testing.T) {
+	var data ScheduledCampaignAd
+	err := json.Unmarshal([]byte(`{"id":"id","Tags":["go"],"ExperienceLevels":["NOT_ENGINEER"],"MinExperienceLevel":"MORE_THAN_2_YEARS"}`), &data)
+	assert.Nil(t, err)
+	assert.Equal(t, "id", data.Id)
+	assert.Empty(t, data.Tags)
+	assert.Empty(t, data.ExperienceLevels)
+	assert.Equal(t, "MORE_THAN_2_YEARS", data.MinExperienceLevel)
+}
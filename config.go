@@ -0,0 +1,590 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the service. It's loaded from the defaults,
+// then from the optional YAML file set by CONFIG_FILE and finally from the
+// environment variables named by the env tags, so each layer overrides the
+// previous one. Durations are set in the environment as integers of the
+// tag's unit and in YAML as strings, e.g. 30s.
+type Config struct {
+	Env             string        `yaml:"env" env:"ENV"`
+	Port            int           `yaml:"port" env:"PORT"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" unit:"s"`
+	GcloudProject   string        `yaml:"gcloudProject" env:"GCLOUD_PROJECT"`
+	CredentialsFile string        `yaml:"credentialsFile" env:"GOOGLE_APPLICATION_CREDENTIALS"`
+	TraceSampling   float64       `yaml:"traceSampling" env:"TRACE_SAMPLING"`
+
+	Database DatabaseConfig `yaml:"database"`
+	// Breakers set in YAML replace the whole default breaker of the provider,
+	// while the environment overrides single settings, e.g. HYSTRIX_BSA_TIMEOUT
+	Hystrix    map[string]BreakerConfig `yaml:"hystrix" envPrefix:"HYSTRIX_"`
+	Providers  ProvidersConfig          `yaml:"providers"`
+	Ivt        IvtConfig                `yaml:"ivt"`
+	RateLimits RateLimitsConfig         `yaml:"rateLimits"`
+	Privacy    PrivacyConfig            `yaml:"privacy"`
+	Inventory  InventoryConfig          `yaml:"inventory"`
+	Consumer   consumerOptions          `yaml:"consumer"`
+	Campaigns  CampaignsConfig          `yaml:"campaigns"`
+	UserTags   UserTagsConfig           `yaml:"userTags"`
+	Images     ImagesConfig             `yaml:"images"`
+	Utm        UtmConfig                `yaml:"utm"`
+	// Experiments split the users of the feed between variants of the
+	// waterfall, they're only set in YAML. The variant of every experiment
+	// is logged with the ad decision.
+	Experiments map[string]ExperimentConfig `yaml:"experiments"`
+	// ProfileCache caches the tags and experience levels of the users read
+	// by the serving path
+	ProfileCache ProfileCacheConfig `yaml:"profileCache"`
+}
+
+type DatabaseConfig struct {
+	ConnectionString string        `yaml:"connectionString" env:"DB_CONNECTION_STRING"`
+	MaxOpenConns     int           `yaml:"maxOpenConns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns     int           `yaml:"maxIdleConns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime  time.Duration `yaml:"connMaxLifetime" env:"DB_CONN_MAX_LIFETIME" unit:"s"`
+	// MigrationsSource overrides the embedded migrations, e.g. file://migrations
+	MigrationsSource string        `yaml:"migrationsSource" env:"MIGRATIONS_SOURCE"`
+	Replica          ReplicaConfig `yaml:"replica"`
+}
+
+// ReplicaConfig is the optional read replica of the serving path, which uses
+// the pool settings of the primary
+type ReplicaConfig struct {
+	ConnectionString string `yaml:"connectionString" env:"DB_REPLICA_CONNECTION_STRING"`
+	// Reads fall back to the primary when the replica lags by more than
+	// MaxLag, 0 tolerates any lag. The lag is read with SHOW SLAVE STATUS,
+	// so the replica user needs the REPLICATION CLIENT privilege unless
+	// MaxLag is 0, otherwise the replica is never used.
+	MaxLag        time.Duration `yaml:"maxLag" env:"DB_REPLICA_MAX_LAG" unit:"s"`
+	CheckInterval time.Duration `yaml:"checkInterval" env:"DB_REPLICA_CHECK_INTERVAL" unit:"s"`
+}
+
+// BreakerConfig is the hystrix configuration of a provider, timeouts and
+// windows are in milliseconds
+type BreakerConfig struct {
+	Timeout                int `yaml:"timeout" env:"TIMEOUT"`
+	MaxConcurrentRequests  int `yaml:"maxConcurrentRequests" env:"MAX_CONCURRENT_REQUESTS"`
+	RequestVolumeThreshold int `yaml:"requestVolumeThreshold" env:"REQUEST_VOLUME_THRESHOLD"`
+	SleepWindow            int `yaml:"sleepWindow" env:"SLEEP_WINDOW"`
+	ErrorPercentThreshold  int `yaml:"errorPercentThreshold" env:"ERROR_PERCENT_THRESHOLD"`
+}
+
+type ProvidersConfig struct {
+	CacheTTL   time.Duration       `yaml:"cacheTTL" env:"PROVIDER_CACHE_TTL" unit:"s"`
+	IpPolicies map[string]ipPolicy `yaml:"ipPolicies" envPrefix:"IP_POLICY_"`
+	CountryIps map[string]string   `yaml:"countryIps" env:"COUNTRY_IPS"`
+	Bsa        BsaConfig           `yaml:"bsa"`
+	EthicalAds EthicalAdsConfig    `yaml:"ethicalAds"`
+	OpenRTB    OpenRTBConfig       `yaml:"openRTB"`
+}
+
+// BsaConfig has the BSA properties of every placement
+type BsaConfig struct {
+	PremiumProperty  string `yaml:"premiumProperty" env:"BSA_PREMIUM_PROPERTY"`
+	StandardProperty string `yaml:"standardProperty" env:"BSA_STANDARD_PROPERTY"`
+	ActiveProperty   string `yaml:"activeProperty" env:"BSA_ACTIVE_PROPERTY"`
+	DefaultProperty  string `yaml:"defaultProperty" env:"BSA_DEFAULT_PROPERTY"`
+	PostProperty     string `yaml:"postProperty" env:"BSA_POST_PROPERTY"`
+	ToiletProperty   string `yaml:"toiletProperty" env:"BSA_TOILET_PROPERTY"`
+	ProxyProperty    string `yaml:"proxyProperty" env:"BSA_PROXY_PROPERTY"`
+	// Properties by country, segment and experience level, set in the
+	// environment as comma separated lists of key=property pairs
+	CountryProperties    map[string]string `yaml:"countryProperties" env:"BSA_COUNTRY_PROPERTIES"`
+	SegmentProperties    map[string]string `yaml:"segmentProperties" env:"BSA_SEGMENT_PROPERTIES"`
+	ExperienceProperties map[string]string `yaml:"experienceProperties" env:"BSA_EXPERIENCE_PROPERTIES"`
+}
+
+type EthicalAdsConfig struct {
+	Token string `yaml:"token" env:"ETHICALADS_TOKEN"`
+}
+
+type OpenRTBConfig struct {
+	// Bidders maps the bidder names to their endpoints
+	Bidders map[string]string `yaml:"bidders" env:"OPENRTB_BIDDERS"`
+	Floor   float64           `yaml:"floor" env:"OPENRTB_FLOOR"`
+	Timeout time.Duration     `yaml:"timeout" env:"OPENRTB_TMAX" unit:"ms"`
+}
+
+type IvtConfig struct {
+	BotList          string `yaml:"botList" env:"IVT_BOT_LIST"`
+	DatacenterRanges string `yaml:"datacenterRanges" env:"IVT_DATACENTER_RANGES"`
+}
+
+type RateLimitsConfig struct {
+	// A per minute limit of 0 disables rate limiting for the placement
+	Placements  map[string]rateLimit `yaml:"placements" envPrefix:"RATE_LIMIT_"`
+	IdleTimeout time.Duration        `yaml:"idleTimeout" env:"RATE_LIMIT_IDLE_TIMEOUT" unit:"s"`
+	// TrustedProxies is the number of proxies in front of the server that
+	// append the address of their client to X-Forwarded-For, the clients are
+	// limited by the address the first of them saw. With 0 the address of
+	// the connection is used.
+	TrustedProxies int `yaml:"trustedProxies" env:"RATE_LIMIT_TRUSTED_PROXIES"`
+}
+
+type PrivacyConfig struct {
+	// The privacy API is disabled without a token
+	ApiToken string `yaml:"apiToken" env:"PRIVACY_API_TOKEN"`
+}
+
+// InventoryConfig sells the untargeted campaigns to the buyers of /openrtb
+type InventoryConfig struct {
+	// Buyers maps the buyer names to the tokens they authenticate with, set
+	// in the environment as a comma separated list of name=token pairs. The
+	// inventory is closed without buyers.
+	Buyers map[string]string `yaml:"buyers" env:"INVENTORY_BUYERS"`
+	// BillingUrl is the public url of /openrtb/billing, the bids ask the
+	// buyers to notify it of the impressions they won
+	BillingUrl string `yaml:"billingUrl" env:"INVENTORY_BILLING_URL"`
+}
+
+type CampaignsConfig struct {
+	// Invalid campaigns are sent to the topic, or to the dead-letter topic of
+	// the consumer when it's empty
+	DeadLetterTopic string `yaml:"deadLetterTopic" env:"CAMPAIGN_DEAD_LETTER_TOPIC"`
+}
+
+type UserTagsConfig struct {
+	// Interest in a tag halves every HalfLife without reads
+	HalfLife time.Duration `yaml:"halfLife" env:"USER_TAG_HALF_LIFE_DAYS" unit:"d"`
+	// Tags that weren't read for longer than Retention are deleted
+	Retention       time.Duration `yaml:"retention" env:"USER_TAG_RETENTION_DAYS" unit:"d"`
+	ViewBatchSize   int           `yaml:"viewBatchSize" env:"VIEW_BATCH_SIZE"`
+	ViewBatchWindow time.Duration `yaml:"viewBatchWindow" env:"VIEW_BATCH_WINDOW" unit:"ms"`
+}
+
+type ImagesConfig struct {
+	// HostRewrites replaces the host, or the host and path prefix, of the
+	// keys by their value, e.g. res.cloudinary.com/daily-now=media.daily.dev
+	HostRewrites map[string]string `yaml:"hostRewrites" env:"IMAGE_HOST_REWRITES"`
+	// The images of the hosts, after the rewrites, are served by Cloudinary
+	// and get the transformations of the placement
+	CloudinaryHosts []string `yaml:"cloudinaryHosts" env:"IMAGE_CLOUDINARY_HOSTS"`
+	// MaxDpr caps the device pixel ratio of the dpr query parameter
+	MaxDpr     float64                   `yaml:"maxDpr" env:"IMAGE_MAX_DPR"`
+	Placements map[string]ImageTransform `yaml:"placements" envPrefix:"IMAGE_"`
+}
+
+// ImageTransform is the Cloudinary transformation of the images of a
+// placement, empty settings are left out
+type ImageTransform struct {
+	// Width is in CSS pixels, the device pixel ratio multiplies it
+	Width   int    `yaml:"width" env:"WIDTH"`
+	Format  string `yaml:"format" env:"FORMAT"`
+	Quality string `yaml:"quality" env:"QUALITY"`
+}
+
+type UtmConfig struct {
+	// Placements have the UTM templates of the campaigns served in them,
+	// which campaigns can override
+	Placements map[string]UtmTemplate `yaml:"placements" envPrefix:"UTM_"`
+}
+
+type ExperimentConfig struct {
+	// Stopped experiments serve the default waterfall to everyone
+	Stopped  bool                     `yaml:"stopped"`
+	Variants map[string]VariantConfig `yaml:"variants"`
+}
+
+// VariantConfig changes the waterfall of the users in the variant, settings
+// left empty keep the default
+type VariantConfig struct {
+	// Weight is the share of the users relative to the other variants
+	Weight int `yaml:"weight"`
+	// Providers is the order of the waterfall, providers left out are skipped
+	Providers []string `yaml:"providers"`
+	// Probabilities are the chances of the providers to be asked for an ad
+	Probabilities map[string]float64 `yaml:"probabilities"`
+	// SegmentProperties replace the BSA properties of the segments
+	SegmentProperties map[string]string `yaml:"segmentProperties"`
+}
+
+type ProfileCacheConfig struct {
+	// A size of 0 disables the cache
+	Size int           `yaml:"size" env:"PROFILE_CACHE_SIZE"`
+	TTL  time.Duration `yaml:"ttl" env:"PROFILE_CACHE_TTL" unit:"s"`
+	// The workers publish the users whose profile changed to the topic,
+	// without it profiles are only refreshed once they expire
+	InvalidationTopic string `yaml:"invalidationTopic" env:"PROFILE_INVALIDATION_TOPIC"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Env:             "DEV",
+		Port:            9090,
+		ShutdownTimeout: 30 * time.Second,
+		TraceSampling:   0.25,
+		Database: DatabaseConfig{
+			MaxOpenConns:    20,
+			MaxIdleConns:    20,
+			ConnMaxLifetime: 3 * time.Minute,
+			Replica: ReplicaConfig{
+				MaxLag:        30 * time.Second,
+				CheckInterval: 5 * time.Second,
+			},
+		},
+		Hystrix: map[string]BreakerConfig{
+			hystrixDb:      {Timeout: 300, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100},
+			hystrixReplica: {Timeout: 150, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100},
+			hystrixBsa:     {Timeout: 700, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100},
+			hystrixEa:      {Timeout: 700, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100},
+			hystrixOpenRTB: {Timeout: 300, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100},
+		},
+		Providers: ProvidersConfig{
+			CacheTTL: 5 * time.Second,
+			IpPolicies: map[string]ipPolicy{
+				hystrixBsa:     ipPolicyFull,
+				hystrixEa:      ipPolicyFull,
+				hystrixOpenRTB: ipPolicyFull,
+			},
+			CountryIps: map[string]string{},
+			Bsa: BsaConfig{
+				PremiumProperty:  "CEBI62JM",
+				StandardProperty: "CEBI62J7",
+				ActiveProperty:   "CEAIP23E",
+				DefaultProperty:  "CK7DT2QM",
+				PostProperty:     "CW7D623L",
+				ToiletProperty:   "CK7DT2QM",
+				ProxyProperty:    "CK7DT2QM",
+				CountryProperties: map[string]string{
+					"united states":  "CK7DT2QM",
+					"united kingdom": "CEAD62QI",
+				},
+				SegmentProperties: map[string]string{
+					"python":       "CW7D52QL",
+					"design-tools": "CW7DEK3M",
+				},
+				ExperienceProperties: map[string]string{},
+			},
+			OpenRTB: OpenRTBConfig{
+				Bidders: map[string]string{},
+				Timeout: 300 * time.Millisecond,
+			},
+		},
+		Ivt: IvtConfig{
+			BotList:          "./ivt/bots.txt",
+			DatacenterRanges: "./ivt/datacenters.txt",
+		},
+		RateLimits: RateLimitsConfig{
+			Placements: map[string]rateLimit{
+				"feed":   {PerMinute: 60, Burst: 20},
+				"post":   {PerMinute: 60, Burst: 20},
+				"toilet": {PerMinute: 60, Burst: 20},
+				"bsa":    {PerMinute: 60, Burst: 20},
+			},
+			IdleTimeout:    10 * time.Minute,
+			TrustedProxies: 1,
+		},
+		Consumer: consumerOptions{
+			Concurrency:     10,
+			MaxAttempts:     5,
+			MinBackoff:      time.Second,
+			MaxBackoff:      time.Minute,
+			DeadLetterTopic: "monetization-dead-letter",
+		},
+		Campaigns: CampaignsConfig{
+			DeadLetterTopic: "monetization-campaign-dead-letter",
+		},
+		UserTags: UserTagsConfig{
+			HalfLife:        30 * 24 * time.Hour,
+			Retention:       180 * 24 * time.Hour,
+			ViewBatchSize:   500,
+			ViewBatchWindow: time.Second,
+		},
+		Images: ImagesConfig{
+			HostRewrites: map[string]string{
+				"res.cloudinary.com/daily-now": "media.daily.dev",
+				"daily-now-res.cloudinary.com": "media.daily.dev",
+			},
+			CloudinaryHosts: []string{"media.daily.dev"},
+			MaxDpr:          3,
+			Placements: map[string]ImageTransform{
+				"feed":   {Format: "auto", Quality: "auto"},
+				"post":   {Format: "auto", Quality: "auto"},
+				"toilet": {Format: "auto", Quality: "auto"},
+			},
+		},
+		Utm: UtmConfig{
+			Placements: map[string]UtmTemplate{
+				"feed":   {Source: "daily.dev", Medium: "native", Campaign: "{campaignId}", Content: "{placement}"},
+				"post":   {Source: "daily.dev", Medium: "native", Campaign: "{campaignId}", Content: "{placement}"},
+				"toilet": {Source: "daily.dev", Medium: "native", Campaign: "{campaignId}", Content: "{placement}"},
+			},
+		},
+		Experiments: map[string]ExperimentConfig{},
+		ProfileCache: ProfileCacheConfig{
+			Size:              100000,
+			TTL:               time.Minute,
+			InvalidationTopic: "monetization-profile-invalidations",
+		},
+	}
+}
+
+// loadConfig loads the config from the YAML file, when path isn't empty, and
+// the environment on top of the defaults
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %w", err)
+		}
+		defer file.Close()
+
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), "", os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"d":  24 * time.Hour,
+}
+
+// applyEnv sets the fields of the struct from the environment variables
+// named by their env tags, maps tagged with envPrefix read every key from
+// the variables named by the prefix and the upper cased key
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	var errs []error
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		if keyPrefix, ok := field.Tag.Lookup("envPrefix"); ok {
+			for _, key := range value.MapKeys() {
+				name := prefix + keyPrefix + strings.ToUpper(key.String())
+				item := reflect.New(value.Type().Elem()).Elem()
+				item.Set(value.MapIndex(key))
+				var err error
+				if item.Kind() == reflect.Struct {
+					err = applyEnv(item, name+"_", lookup)
+				} else if env, ok := lookup(name); ok {
+					err = setFromEnv(item, name, env, "")
+				}
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				value.SetMapIndex(key, item)
+			}
+			continue
+		}
+
+		if value.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(value, prefix, lookup))
+			continue
+		}
+
+		tag, ok := field.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		name := prefix + tag
+		if env, ok := lookup(name); ok {
+			errs = append(errs, setFromEnv(value, name, env, field.Tag.Get("unit")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setFromEnv(value reflect.Value, name string, env string, unit string) error {
+	switch {
+	case value.Type() == reflect.TypeOf(time.Duration(0)):
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", name, env)
+		}
+		value.SetInt(int64(time.Duration(n) * durationUnits[unit]))
+	case value.Kind() == reflect.String:
+		value.SetString(env)
+	case value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", name, env)
+		}
+		value.SetInt(int64(n))
+	case value.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", name, env)
+		}
+		value.SetFloat(n)
+	case value.Kind() == reflect.Map && value.Type().Elem().Kind() == reflect.String:
+		value.Set(reflect.ValueOf(parseKeyValues(env)))
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		value.Set(reflect.ValueOf(parseList(env)))
+	default:
+		return fmt.Errorf("%s: unsupported type %s", name, value.Type())
+	}
+	return nil
+}
+
+// validate checks the config and returns all the problems it found
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, field string, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Env == "DEV" || c.Env == "PROD", "env", "must be DEV or PROD, got %q", c.Env)
+	check(c.Port > 0 && c.Port < 65536, "port", "must be a valid port, got %d", c.Port)
+	check(c.ShutdownTimeout > 0, "shutdownTimeout", "must be positive")
+	check(c.TraceSampling >= 0 && c.TraceSampling <= 1, "traceSampling", "must be between 0 and 1, got %v", c.TraceSampling)
+	check(c.Env != "PROD" || c.GcloudProject != "", "gcloudProject", "is required in PROD")
+
+	check(c.Database.ConnectionString != "", "database.connectionString", "is required")
+	check(c.Database.MaxOpenConns > 0, "database.maxOpenConns", "must be positive")
+	check(c.Database.MaxIdleConns >= 0 && c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "database.maxIdleConns", "must be between 0 and maxOpenConns")
+	check(c.Database.ConnMaxLifetime >= 0, "database.connMaxLifetime", "must not be negative")
+	check(c.Database.Replica.MaxLag >= 0, "database.replica.maxLag", "must not be negative")
+	check(c.Database.Replica.CheckInterval > 0, "database.replica.checkInterval", "must be positive")
+
+	for _, provider := range sortedKeys(c.Hystrix) {
+		breaker := c.Hystrix[provider]
+		field := "hystrix." + provider
+		check(breaker.Timeout > 0, field+".timeout", "must be positive")
+		check(breaker.MaxConcurrentRequests > 0, field+".maxConcurrentRequests", "must be positive")
+		check(breaker.RequestVolumeThreshold >= 0, field+".requestVolumeThreshold", "must not be negative")
+		check(breaker.SleepWindow >= 0, field+".sleepWindow", "must not be negative")
+		check(breaker.ErrorPercentThreshold >= 0 && breaker.ErrorPercentThreshold <= 100, field+".errorPercentThreshold", "must be between 0 and 100")
+	}
+
+	check(c.Providers.CacheTTL >= 0, "providers.cacheTTL", "must not be negative")
+	for _, provider := range sortedKeys(c.Providers.IpPolicies) {
+		policy := c.Providers.IpPolicies[provider]
+		check(policy == ipPolicyFull || policy == ipPolicyTruncated || policy == ipPolicyCountry,
+			"providers.ipPolicies."+provider, "must be full, truncated or country, got %q", policy)
+	}
+	for _, country := range sortedKeys(c.Providers.CountryIps) {
+		check(net.ParseIP(c.Providers.CountryIps[country]) != nil, "providers.countryIps."+country, "%q is not an ip", c.Providers.CountryIps[country])
+	}
+	bsa := c.Providers.Bsa
+	for field, property := range map[string]string{
+		"premiumProperty":  bsa.PremiumProperty,
+		"standardProperty": bsa.StandardProperty,
+		"activeProperty":   bsa.ActiveProperty,
+		"defaultProperty":  bsa.DefaultProperty,
+		"postProperty":     bsa.PostProperty,
+		"toiletProperty":   bsa.ToiletProperty,
+		"proxyProperty":    bsa.ProxyProperty,
+	} {
+		check(property != "", "providers.bsa."+field, "is required")
+	}
+	for _, level := range sortedKeys(bsa.ExperienceProperties) {
+		check(isValidExperienceLevel(level), "providers.bsa.experienceProperties."+level, "is not an experience level")
+	}
+	for _, name := range sortedKeys(c.Providers.OpenRTB.Bidders) {
+		endpoint, err := url.Parse(c.Providers.OpenRTB.Bidders[name])
+		check(err == nil && (endpoint.Scheme == "http" || endpoint.Scheme == "https") && endpoint.Host != "",
+			"providers.openRTB.bidders."+name, "%q is not an http url", c.Providers.OpenRTB.Bidders[name])
+	}
+	check(c.Providers.OpenRTB.Floor >= 0, "providers.openRTB.floor", "must not be negative")
+	check(c.Providers.OpenRTB.Timeout > 0, "providers.openRTB.timeout", "must be positive")
+
+	for field, path := range map[string]string{"ivt.botList": c.Ivt.BotList, "ivt.datacenterRanges": c.Ivt.DatacenterRanges} {
+		if path != "" {
+			_, err := os.Stat(path)
+			check(err == nil, field, "%v", err)
+		}
+	}
+
+	for _, placement := range sortedKeys(c.RateLimits.Placements) {
+		limit := c.RateLimits.Placements[placement]
+		check(limit.PerMinute >= 0, "rateLimits.placements."+placement+".perMinute", "must not be negative")
+		check(limit.PerMinute == 0 || limit.Burst > 0, "rateLimits.placements."+placement+".burst", "must be positive")
+	}
+	check(c.RateLimits.IdleTimeout > 0, "rateLimits.idleTimeout", "must be positive")
+	check(c.RateLimits.TrustedProxies >= 0, "rateLimits.trustedProxies", "must not be negative")
+
+	for _, name := range sortedKeys(c.Inventory.Buyers) {
+		check(c.Inventory.Buyers[name] != "", "inventory.buyers."+name, "is required")
+	}
+	if len(c.Inventory.Buyers) > 0 {
+		billing, err := url.Parse(c.Inventory.BillingUrl)
+		check(err == nil && (billing.Scheme == "http" || billing.Scheme == "https") && billing.Host != "",
+			"inventory.billingUrl", "%q is not an http url", c.Inventory.BillingUrl)
+	}
+
+	check(c.Consumer.Concurrency > 0, "consumer.concurrency", "must be positive")
+	check(c.Consumer.MaxAttempts >= 0, "consumer.maxAttempts", "must not be negative")
+	check(c.Consumer.MinBackoff > 0 && c.Consumer.MinBackoff <= c.Consumer.MaxBackoff, "consumer.minBackoff", "must be positive and not greater than maxBackoff")
+	// The retry policy of Pub/Sub backs off for 10 minutes at most
+	check(c.Consumer.MaxBackoff <= 10*time.Minute, "consumer.maxBackoff", "must not be greater than 10m")
+
+	check(c.UserTags.HalfLife > 0, "userTags.halfLife", "must be positive")
+	check(c.UserTags.Retention > 0, "userTags.retention", "must be positive")
+	check(c.UserTags.ViewBatchSize > 0, "userTags.viewBatchSize", "must be positive")
+	check(c.UserTags.ViewBatchWindow > 0, "userTags.viewBatchWindow", "must be positive")
+
+	for _, from := range sortedKeys(c.Images.HostRewrites) {
+		check(from != "" && c.Images.HostRewrites[from] != "", "images.hostRewrites."+from, "must rewrite a host to another")
+	}
+	check(c.Images.MaxDpr >= 1, "images.maxDpr", "must be at least 1, got %v", c.Images.MaxDpr)
+	for _, placement := range sortedKeys(c.Images.Placements) {
+		check(c.Images.Placements[placement].Width >= 0, "images.placements."+placement+".width", "must not be negative")
+	}
+
+	for _, name := range sortedKeys(c.Experiments) {
+		experiment := c.Experiments[name]
+		field := "experiments." + name
+		check(experiment.Stopped || len(experiment.Variants) > 0, field+".variants", "are required")
+		for _, variant := range sortedKeys(experiment.Variants) {
+			settings := experiment.Variants[variant]
+			field := field + ".variants." + variant
+			check(settings.Weight > 0, field+".weight", "must be positive")
+			seen := make(map[string]bool)
+			for _, provider := range settings.Providers {
+				check(isWaterfallProvider(provider), field+".providers", "%q is not a provider", provider)
+				check(!seen[provider], field+".providers", "%q is repeated", provider)
+				seen[provider] = true
+			}
+			for _, provider := range sortedKeys(settings.Probabilities) {
+				probability := settings.Probabilities[provider]
+				check(isWaterfallProvider(provider), field+".probabilities."+provider, "is not a provider")
+				check(probability >= 0 && probability <= 1, field+".probabilities."+provider, "must be between 0 and 1, got %v", probability)
+			}
+		}
+	}
+
+	check(c.ProfileCache.Size >= 0, "profileCache.size", "must not be negative")
+	check(c.ProfileCache.Size == 0 || c.ProfileCache.TTL > 0, "profileCache.ttl", "must be positive")
+
+	// Sort the errors so they're reported in a stable order
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+	return errors.Join(errs...)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
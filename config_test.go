@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig is loaded from the environment, like DB_CONNECTION_STRING of the
+// test database
+var testConfig = func() *Config {
+	cfg, err := loadConfig("")
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}()
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+port: 8080
+shutdownTimeout: 10s
+database:
+  connectionString: root@tcp(localhost:3306)/test
+hystrix:
+  BSA:
+    timeout: 500
+    maxConcurrentRequests: 100
+providers:
+  ipPolicies:
+    OpenRTB: country
+  bsa:
+    segmentProperties:
+      golang: GOLANG
+rateLimits:
+  placements:
+    feed:
+      perMinute: 120
+      burst: 40
+`)
+	t.Setenv("PORT", "9000")
+	t.Setenv("HYSTRIX_BSA_SLEEP_WINDOW", "2000")
+	t.Setenv("IP_POLICY_BSA", "truncated")
+	t.Setenv("RATE_LIMIT_POST_BURST", "5")
+	t.Setenv("OPENRTB_TMAX", "150")
+	t.Setenv("USER_TAG_HALF_LIFE_DAYS", "7")
+	t.Setenv("BSA_COUNTRY_PROPERTIES", "germany=GERMANY, invalid")
+	t.Setenv("IMAGE_CLOUDINARY_HOSTS", "media.daily.dev, images.daily.dev,")
+	t.Setenv("IMAGE_FEED_WIDTH", "400")
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, 9000, cfg.Port)
+	assert.Equal(t, 10*time.Second, cfg.ShutdownTimeout)
+	assert.Equal(t, "root@tcp(localhost:3306)/test", cfg.Database.ConnectionString)
+	assert.Equal(t, 20, cfg.Database.MaxOpenConns)
+	assert.Equal(t, BreakerConfig{Timeout: 500, MaxConcurrentRequests: 100, SleepWindow: 2000}, cfg.Hystrix[hystrixBsa])
+	assert.Equal(t, 300, cfg.Hystrix[hystrixDb].Timeout)
+	assert.Equal(t, ipPolicyTruncated, cfg.Providers.IpPolicies[hystrixBsa])
+	assert.Equal(t, ipPolicyCountry, cfg.Providers.IpPolicies[hystrixOpenRTB])
+	assert.Equal(t, "GOLANG", cfg.Providers.Bsa.SegmentProperties["golang"])
+	assert.Equal(t, "CW7D52QL", cfg.Providers.Bsa.SegmentProperties["python"])
+	assert.Equal(t, map[string]string{"germany": "GERMANY"}, cfg.Providers.Bsa.CountryProperties)
+	assert.Equal(t, 150*time.Millisecond, cfg.Providers.OpenRTB.Timeout)
+	assert.Equal(t, rateLimit{PerMinute: 120, Burst: 40}, cfg.RateLimits.Placements["feed"])
+	assert.Equal(t, rateLimit{PerMinute: 60, Burst: 5}, cfg.RateLimits.Placements["post"])
+	assert.Equal(t, 7*24*time.Hour, cfg.UserTags.HalfLife)
+	assert.Equal(t, []string{"media.daily.dev", "images.daily.dev"}, cfg.Images.CloudinaryHosts)
+	assert.Equal(t, ImageTransform{Width: 400, Format: "auto", Quality: "auto"}, cfg.Images.Placements["feed"])
+	assert.NoError(t, cfg.validate())
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := loadConfig(writeConfigFile(t, "unknown: true\n"))
+	assert.ErrorContains(t, err, "field unknown not found")
+
+	_, err = loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to open config file")
+
+	t.Setenv("PORT", "http")
+	t.Setenv("HYSTRIX_ETHICALADS_TIMEOUT", "fast")
+	_, err = loadConfig("")
+	assert.ErrorContains(t, err, `PORT: "http" is not an integer`)
+	assert.ErrorContains(t, err, `HYSTRIX_ETHICALADS_TIMEOUT: "fast" is not an integer`)
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Database.ConnectionString = "root@tcp(localhost:3306)/test"
+	assert.NoError(t, cfg.validate())
+
+	cfg.Env = "STAGING"
+	cfg.Providers.IpPolicies[hystrixEa] = "none"
+	cfg.Providers.OpenRTB.Bidders = map[string]string{"a": "ftp://a.com"}
+	cfg.Providers.Bsa.ExperienceProperties = map[string]string{"SENIOR": "SENIOR"}
+	cfg.RateLimits.Placements["feed"] = rateLimit{PerMinute: 10}
+	cfg.Inventory.Buyers = map[string]string{"acme": ""}
+	cfg.Consumer.MinBackoff = time.Hour
+	cfg.ProfileCache.TTL = 0
+	cfg.Experiments = map[string]ExperimentConfig{
+		"empty":   {},
+		"stopped": {Stopped: true},
+		"order": {Variants: map[string]VariantConfig{
+			"control": {Weight: 1},
+			"test": {
+				Providers:     []string{"bsa", "carbon", "bsa"},
+				Probabilities: map[string]float64{"bsa": 2},
+			},
+		}},
+	}
+	err := cfg.validate()
+	assert.EqualError(t, err, `consumer.minBackoff: must be positive and not greater than maxBackoff
+env: must be DEV or PROD, got "STAGING"
+experiments.empty.variants: are required
+experiments.order.variants.test.probabilities.bsa: must be between 0 and 1, got 2
+experiments.order.variants.test.providers: "bsa" is repeated
+experiments.order.variants.test.providers: "carbon" is not a provider
+experiments.order.variants.test.weight: must be positive
+inventory.billingUrl: "" is not an http url
+inventory.buyers.acme: is required
+profileCache.ttl: must be positive
+providers.bsa.experienceProperties.SENIOR: is not an experience level
+providers.ipPolicies.EthicalAds: must be full, truncated or country, got "none"
+providers.openRTB.bidders.a: "ftp://a.com" is not an http url
+rateLimits.placements.feed.burst: must be positive`)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type consent struct {
+	Personalized bool
+	Reason       string
+}
+
+type consentKey struct{}
+
+// Purposes of the IAB TCF v2 required to serve personalized ads: store and
+// access information, create a personalised ads profile and select
+// personalised ads
+var tcfPersonalizationPurposes = []int{1, 3, 4}
+
+// Purposes of the IAB TCF v2 required to sell an untargeted ad: store and
+// access information and use limited data to select advertising
+var tcfBasicAdsPurposes = []int{1, 2}
+
+const tcfConsentCookie = "euconsent-v2"
+const tcfConsentHeader = "x-tcf-consent"
+
+var errInvalidTcfString = errors.New("invalid tcf consent string")
+
+// tcfPurposesConsent decodes the purposes the user consented to from the core
+// segment of a TCF v2 consent string
+func tcfPurposesConsent(value string) (map[int]bool, error) {
+	core := strings.TrimRight(strings.Split(value, ".")[0], "=")
+	data, err := base64.RawURLEncoding.DecodeString(core)
+	if err != nil {
+		return nil, err
+	}
+
+	bit := func(offset int) bool {
+		return data[offset/8]&(1<<(7-offset%8)) != 0
+	}
+
+	// The purposes consent bits follow 152 bits of metadata
+	const purposesOffset = 152
+	const purposesCount = 24
+	if len(data)*8 < purposesOffset+purposesCount {
+		return nil, errInvalidTcfString
+	}
+	version := data[0] >> 2
+	if version != 2 {
+		return nil, errInvalidTcfString
+	}
+
+	purposes := make(map[int]bool)
+	for i := 0; i < purposesCount; i++ {
+		if bit(purposesOffset + i) {
+			purposes[i+1] = true
+		}
+	}
+	return purposes, nil
+}
+
+func getTcfString(r *http.Request) string {
+	if value := r.Header.Get(tcfConsentHeader); value != "" {
+		return value
+	}
+	if cookie, _ := r.Cookie(tcfConsentCookie); cookie != nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// getConsent determines whether the request may be served personalized ads
+// based on the Global Privacy Control, Do Not Track and TCF v2 signals
+func getConsent(r *http.Request) consent {
+	if r.Header.Get("Sec-GPC") == "1" {
+		return consent{Reason: "gpc"}
+	}
+	if r.Header.Get("DNT") == "1" {
+		return consent{Reason: "dnt"}
+	}
+
+	if value := getTcfString(r); value != "" {
+		purposes, err := tcfPurposesConsent(value)
+		if err != nil {
+			return consent{Reason: "tcf_invalid"}
+		}
+		for _, purpose := range tcfPersonalizationPurposes {
+			if !purposes[purpose] {
+				return consent{Reason: "tcf"}
+			}
+		}
+	}
+
+	return consent{Personalized: true}
+}
+
+func withConsent(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), consentKey{}, getConsent(r)))
+}
+
+// consentFromContext returns the consent of the request, requests that went
+// through withConsent are personalized only if the user allowed it
+func consentFromContext(ctx context.Context) consent {
+	if c, ok := ctx.Value(consentKey{}).(consent); ok {
+		return c
+	}
+	return consent{Personalized: true}
+}
+
+// truncateIp zeroes the host part of the address, keeping a /24 for IPv4 and
+// a /48 for IPv6
+func truncateIp(ip string) string {
+	ip = strings.TrimSpace(ip)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
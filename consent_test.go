@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTcfString encodes a minimal TCF v2 core string with the given purposes
+func newTcfString(purposes ...int) string {
+	data := make([]byte, 30)
+	setBit := func(offset int) {
+		data[offset/8] |= 1 << (7 - offset%8)
+	}
+	// Version 2 in the first 6 bits
+	setBit(4)
+	for _, purpose := range purposes {
+		setBit(152 + purpose - 1)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestTcfPurposesConsent(t *testing.T) {
+	purposes, err := tcfPurposesConsent(newTcfString(1, 3, 4, 24) + ".YAAAAAAAAAA")
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]bool{1: true, 3: true, 4: true, 24: true}, purposes)
+
+	_, err = tcfPurposesConsent("short")
+	assert.Error(t, err)
+	_, err = tcfPurposesConsent("not base64!")
+	assert.Error(t, err)
+}
+
+func TestGetConsent(t *testing.T) {
+	cases := []struct {
+		name     string
+		headers  map[string]string
+		cookie   string
+		expected consent
+	}{
+		{name: "no signals", expected: consent{Personalized: true}},
+		{name: "gpc", headers: map[string]string{"Sec-GPC": "1"}, expected: consent{Reason: "gpc"}},
+		{name: "dnt", headers: map[string]string{"DNT": "1"}, expected: consent{Reason: "dnt"}},
+		{name: "dnt off", headers: map[string]string{"DNT": "0"}, expected: consent{Personalized: true}},
+		{name: "tcf consent", headers: map[string]string{"X-TCF-Consent": newTcfString(1, 2, 3, 4)}, expected: consent{Personalized: true}},
+		{name: "tcf no consent", headers: map[string]string{"X-TCF-Consent": newTcfString(1, 2)}, expected: consent{Reason: "tcf"}},
+		{name: "tcf cookie", cookie: newTcfString(1), expected: consent{Reason: "tcf"}},
+		{name: "tcf invalid", cookie: "invalid", expected: consent{Reason: "tcf_invalid"}},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/a", nil)
+		assert.Nil(t, err)
+		for key, value := range c.headers {
+			req.Header.Set(key, value)
+		}
+		if c.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: tcfConsentCookie, Value: c.cookie})
+		}
+		assert.Equal(t, c.expected, getConsent(req), c.name)
+	}
+}
+
+func TestTruncateIp(t *testing.T) {
+	assert.Equal(t, "208.98.185.0", truncateIp("208.98.185.89"))
+	assert.Equal(t, "208.98.185.0", truncateIp("208.98.185.89:4312"))
+	assert.Equal(t, "2001:db8:85a3::", truncateIp("2001:db8:85a3:8d3:1319:8a2e:370:7348"))
+	assert.Equal(t, "", truncateIp("invalid"))
+}
+
+func TestNonPersonalizedAd(t *testing.T) {
+	stores := newTestStores()
+	stores.UserTags = userTagsFunc(func(ctx context.Context, userId string) ([]string, error) {
+		t.Fatal("user tags should not be loaded")
+		return nil, nil
+	})
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		assert.Equal(t, "", userId)
+		return nil, nil
+	})
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	var properties []string
+	fetchBsa = func(p *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
+		properties = append(properties, propertyId)
+		assert.Equal(t, "208.98.185.0", p.ipAddress(r, hystrixBsa))
+		return nil, nil
+	}
+	fetchEthicalAds = func(_ *adProviders, r *http.Request, keywords []string) (*EthicalAdsAd, error) {
+		assert.Nil(t, keywords)
+		return nil, nil
+	}
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	setBrowserHeaders(req)
+	req.Header.Set("Sec-GPC", "1")
+	req.Header.Set("x-forwarded-for", "208.98.185.89")
+	req.AddCookie(&http.Cookie{Name: "da2", Value: "1"})
+
+	rr := httptest.NewRecorder()
+	router := createApp(testConfig, stores)
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
+	assert.Equal(t, []string{"CEBI62JM", "CK7DT2QM", "CEBI62J7"}, properties)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+type consumerOutcome string
+
+const (
+	outcomeAck        consumerOutcome = "ack"
+	outcomeNack       consumerOutcome = "nack"
+	outcomeDeadLetter consumerOutcome = "dead_letter"
+)
+
+type consumerOptions struct {
+	Concurrency int `yaml:"concurrency" env:"CONSUMER_CONCURRENCY"`
+	MaxAttempts int `yaml:"maxAttempts" env:"CONSUMER_MAX_ATTEMPTS"`
+	// The backoff of failed messages is the retry policy provisioned with
+	// the subscriptions, Pub/Sub delays the redelivery of nacked messages.
+	// The consumer warns when the policy doesn't match.
+	MinBackoff      time.Duration `yaml:"minBackoff" env:"CONSUMER_MIN_BACKOFF" unit:"s"`
+	MaxBackoff      time.Duration `yaml:"maxBackoff" env:"CONSUMER_MAX_BACKOFF" unit:"s"`
+	DeadLetterTopic string        `yaml:"deadLetterTopic" env:"DEAD_LETTER_TOPIC"`
+}
+
+// consumer receives the messages of a subscription, decodes them to T and
+// passes them to the handler. Messages that can't be decoded or keep failing
+// are forwarded to the dead-letter topic.
+type consumer[T any] struct {
+	client       *pubsub.Client
+	subscription string
+	handler      func(ctx context.Context, log *log.Entry, data T) error
+	options      consumerOptions
+	// decode is nil for subscriptions whose messages have no payload
+	decode func(data []byte, target *T) error
+
+	// attempts counts deliveries when the subscription has no dead-letter
+	// policy, in which case Pub/Sub doesn't report the delivery attempt
+	attempts      map[string]*deliveryCount
+	attemptsMutex sync.Mutex
+}
+
+type deliveryCount struct {
+	count    int
+	lastSeen time.Time
+}
+
+// maxTrackedAttempts bounds the deliveries counted by a consumer, the counts
+// of messages that were redelivered to other instances are never forgotten
+// otherwise
+const maxTrackedAttempts = 10000
+
+func newConsumer[T any](client *pubsub.Client, subscription string, options consumerOptions, handler func(ctx context.Context, log *log.Entry, data T) error) *consumer[T] {
+	return &consumer[T]{
+		client:       client,
+		subscription: subscription,
+		handler:      handler,
+		options:      options,
+		attempts:     make(map[string]*deliveryCount),
+		decode: func(data []byte, target *T) error {
+			return json.Unmarshal(data, target)
+		},
+	}
+}
+
+// rejectionReason tells which field of a message is invalid and why
+type rejectionReason struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// rejectionError is returned by handlers for messages that can never be
+// processed, they're sent to the dead-letter topic right away with their
+// reasons
+type rejectionError struct {
+	Reasons []rejectionReason
+}
+
+func (e *rejectionError) Error() string {
+	reasons := make([]string, len(e.Reasons))
+	for i, reason := range e.Reasons {
+		reasons[i] = reason.Field + ": " + reason.Reason
+	}
+	return "rejected, " + strings.Join(reasons, ", ")
+}
+
+var publishDeadLetter = func(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message, subscription string, reason error) error {
+	attributes := map[string]string{
+		"subscription": subscription,
+		"messageId":    msg.ID,
+		"error":        reason.Error(),
+	}
+	// Rejected messages carry the reasons as JSON so they can be processed
+	var rejection *rejectionError
+	if errors.As(reason, &rejection) {
+		js, err := json.Marshal(rejection.Reasons)
+		if err != nil {
+			return err
+		}
+		attributes["reasons"] = string(js)
+	}
+	res := topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attributes})
+	_, err := res.Get(ctx)
+	return err
+}
+
+func (c *consumer[T]) deliveryAttempt(msg *pubsub.Message) int {
+	if msg.DeliveryAttempt != nil {
+		return *msg.DeliveryAttempt
+	}
+
+	c.attemptsMutex.Lock()
+	defer c.attemptsMutex.Unlock()
+
+	now := time.Now()
+	attempts, ok := c.attempts[msg.ID]
+	if !ok {
+		if len(c.attempts) >= maxTrackedAttempts {
+			c.sweepAttempts(now)
+		}
+		// Still full, the message is retried until there's room to count it
+		if len(c.attempts) >= maxTrackedAttempts {
+			return 1
+		}
+		attempts = &deliveryCount{}
+		c.attempts[msg.ID] = attempts
+	}
+	attempts.count++
+	attempts.lastSeen = now
+	return attempts.count
+}
+
+// sweepAttempts forgets the messages that weren't redelivered for longer than
+// the maximum backoff and ack deadline, they went to another instance. Must be
+// called with the mutex held.
+func (c *consumer[T]) sweepAttempts(now time.Time) {
+	for id, attempts := range c.attempts {
+		if now.Sub(attempts.lastSeen) > c.options.MaxBackoff+10*time.Minute {
+			delete(c.attempts, id)
+		}
+	}
+}
+
+func (c *consumer[T]) forget(msg *pubsub.Message) {
+	c.attemptsMutex.Lock()
+	defer c.attemptsMutex.Unlock()
+	delete(c.attempts, msg.ID)
+}
+
+func (c *consumer[T]) retryPolicy() *pubsub.RetryPolicy {
+	return &pubsub.RetryPolicy{MinimumBackoff: c.options.MinBackoff, MaximumBackoff: c.options.MaxBackoff}
+}
+
+// matchesRetryPolicy tells whether the retry policy of a subscription backs
+// off like the options
+func (c *consumer[T]) matchesRetryPolicy(policy *pubsub.RetryPolicy) bool {
+	expected := c.retryPolicy()
+	return policy != nil && policy.MinimumBackoff == expected.MinimumBackoff &&
+		policy.MaximumBackoff == expected.MaximumBackoff
+}
+
+// checkRetryPolicy warns when the retry policy of the subscription doesn't
+// match the backoff of the options. The policy is provisioned along with the
+// subscription, so the consumer only reads it.
+func (c *consumer[T]) checkRetryPolicy(ctx context.Context, sub *pubsub.Subscription) {
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		log.Warnf("failed to read the retry policy of %s %v", c.subscription, err)
+		return
+	}
+	if !c.matchesRetryPolicy(cfg.RetryPolicy) {
+		expected := c.retryPolicy()
+		log.Warnf("the retry policy of %s doesn't back off from %v to %v like the consumer expects",
+			c.subscription, expected.MinimumBackoff, expected.MaximumBackoff)
+	}
+}
+
+func (c *consumer[T]) deadLetter(ctx context.Context, childLog *log.Entry, msg *pubsub.Message, reason error) consumerOutcome {
+	if c.options.DeadLetterTopic == "" {
+		childLog.Warnf("dropping message without a dead-letter topic %v", reason)
+		return outcomeAck
+	}
+	if err := publishDeadLetter(ctx, c.client.Topic(c.options.DeadLetterTopic), msg, c.subscription, reason); err != nil {
+		childLog.Errorf("failed to publish to dead-letter topic %v", err)
+		return outcomeNack
+	}
+	childLog.Warnf("message was sent to dead-letter topic %v", reason)
+	return outcomeDeadLetter
+}
+
+// process handles a single message and returns what should happen with it
+// along with the delivery attempt of failed messages
+func (c *consumer[T]) process(ctx context.Context, msg *pubsub.Message) (consumerOutcome, int) {
+	childLog := log.WithField("messageId", msg.ID).WithField("subscription", c.subscription)
+
+	var data T
+	if c.decode != nil {
+		if err := c.decode(msg.Data, &data); err != nil {
+			childLog.Errorf("failed to decode message %v", err)
+			recordConsumerMetric(ctx, c.subscription, consumerDecodeFailures)
+			return c.deadLetter(ctx, childLog, msg, err), 0
+		}
+	}
+
+	err := c.handler(ctx, childLog, data)
+	if err == nil {
+		return outcomeAck, 0
+	}
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		return c.deadLetter(ctx, childLog, msg, err), 0
+	}
+
+	attempt := c.deliveryAttempt(msg)
+	if c.options.MaxAttempts > 0 && attempt >= c.options.MaxAttempts {
+		return c.deadLetter(ctx, childLog, msg, fmt.Errorf("failed after %d attempts: %w", attempt, err)), attempt
+	}
+	return outcomeNack, attempt
+}
+
+func (c *consumer[T]) run(ctx context.Context) error {
+	log.Info("receiving messages from ", c.subscription)
+	sub := c.client.Subscription(c.subscription)
+	sub.ReceiveSettings.MaxOutstandingMessages = c.options.Concurrency
+	sub.ReceiveSettings.NumGoroutines = 1
+	c.checkRetryPolicy(ctx, sub)
+
+	err := sub.Receive(ctx, func(receiveCtx context.Context, msg *pubsub.Message) {
+		// Let in-flight messages finish when shutting down
+		ctx := context.WithoutCancel(receiveCtx)
+		start := time.Now()
+		recordConsumerMetric(ctx, c.subscription, consumerReceived)
+
+		outcome, _ := c.process(ctx, msg)
+		recordConsumerOutcome(ctx, c.subscription, outcome, time.Since(start))
+		if outcome == outcomeNack {
+			// The retry policy delays the redelivery, so the message
+			// doesn't hold a slot of the subscription while backing off
+			msg.Nack()
+			return
+		}
+		c.forget(msg)
+		msg.Ack()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to receive messages from %s: %w", c.subscription, err)
+	}
+	return nil
+}
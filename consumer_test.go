@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+type deadLetter struct {
+	topic        string
+	subscription string
+	data         string
+}
+
+func mockDeadLetter(t *testing.T, err error) *[]deadLetter {
+	var published []deadLetter
+	original := publishDeadLetter
+	publishDeadLetter = func(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message, subscription string, reason error) error {
+		published = append(published, deadLetter{topic: topic.ID(), subscription: subscription, data: string(msg.Data)})
+		return err
+	}
+	t.Cleanup(func() {
+		publishDeadLetter = original
+	})
+	return &published
+}
+
+func newTestConsumer(handler func(ctx context.Context, log *log.Entry, data ViewMessage) error) *consumer[ViewMessage] {
+	client, _ := pubsub.NewClient(context.Background(), "test", option.WithoutAuthentication())
+	c := newConsumer(client, "views", testConfig.Consumer, handler)
+	c.options = consumerOptions{MaxAttempts: 3, MinBackoff: time.Second, MaxBackoff: time.Second * 5, DeadLetterTopic: "dead-letter"}
+	return c
+}
+
+func TestConsumerAck(t *testing.T) {
+	published := mockDeadLetter(t, nil)
+	var received ViewMessage
+	c := newTestConsumer(func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		received = data
+		return nil
+	})
+
+	outcome, _ := c.process(context.Background(), &pubsub.Message{ID: "1", Data: []byte(`{"userId":"u","tags":["go"]}`)})
+	assert.Equal(t, outcomeAck, outcome)
+	assert.Equal(t, ViewMessage{UserId: "u", Tags: []string{"go"}}, received)
+	assert.Empty(t, *published)
+}
+
+func TestConsumerMalformedMessage(t *testing.T) {
+	published := mockDeadLetter(t, nil)
+	c := newTestConsumer(func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		t.Fatal("handler should not be called")
+		return nil
+	})
+
+	outcome, _ := c.process(context.Background(), &pubsub.Message{ID: "1", Data: []byte(`not json`)})
+	assert.Equal(t, outcomeDeadLetter, outcome)
+	assert.Equal(t, []deadLetter{{topic: "dead-letter", subscription: "views", data: "not json"}}, *published)
+}
+
+func TestConsumerMaxAttempts(t *testing.T) {
+	published := mockDeadLetter(t, nil)
+	c := newTestConsumer(func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		return errors.New("error")
+	})
+	msg := &pubsub.Message{ID: "1", Data: []byte(`{}`)}
+
+	outcome, attempt := c.process(context.Background(), msg)
+	assert.Equal(t, outcomeNack, outcome)
+	assert.Equal(t, 1, attempt)
+	outcome, attempt = c.process(context.Background(), msg)
+	assert.Equal(t, outcomeNack, outcome)
+	assert.Equal(t, 2, attempt)
+	assert.Empty(t, *published)
+
+	outcome, _ = c.process(context.Background(), msg)
+	assert.Equal(t, outcomeDeadLetter, outcome)
+	assert.Len(t, *published, 1)
+
+	deliveryAttempt := 3
+	outcome, _ = c.process(context.Background(), &pubsub.Message{ID: "2", Data: []byte(`{}`), DeliveryAttempt: &deliveryAttempt})
+	assert.Equal(t, outcomeDeadLetter, outcome)
+}
+
+func TestConsumerRejectedMessage(t *testing.T) {
+	published := mockDeadLetter(t, nil)
+	c := newTestConsumer(func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		return fmt.Errorf("view: %w", &rejectionError{Reasons: []rejectionReason{{Field: "userId", Reason: "is required"}}})
+	})
+
+	outcome, attempt := c.process(context.Background(), &pubsub.Message{ID: "1", Data: []byte(`{}`)})
+	assert.Equal(t, outcomeDeadLetter, outcome, "rejected messages should not be retried")
+	assert.Equal(t, 0, attempt)
+	assert.Len(t, *published, 1)
+}
+
+func TestConsumerDeadLetterFail(t *testing.T) {
+	mockDeadLetter(t, errors.New("error"))
+	c := newTestConsumer(func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		return nil
+	})
+
+	outcome, _ := c.process(context.Background(), &pubsub.Message{ID: "1", Data: []byte(`not json`)})
+	assert.Equal(t, outcomeNack, outcome)
+}
+
+func TestConsumerRetryPolicy(t *testing.T) {
+	c := newTestConsumer(nil)
+	assert.Equal(t, &pubsub.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Second * 5}, c.retryPolicy())
+	assert.True(t, c.matchesRetryPolicy(&pubsub.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Second * 5}))
+	assert.False(t, c.matchesRetryPolicy(&pubsub.RetryPolicy{MinimumBackoff: time.Second, MaximumBackoff: time.Minute}))
+	assert.False(t, c.matchesRetryPolicy(nil), "subscriptions without a policy redeliver right away")
+}
+
+func TestConsumerAttemptsBounded(t *testing.T) {
+	c := newTestConsumer(nil)
+	for i := 0; i < maxTrackedAttempts; i++ {
+		c.attempts[fmt.Sprint(i)] = &deliveryCount{count: 1, lastSeen: time.Now().Add(-time.Hour)}
+	}
+
+	assert.Equal(t, 1, c.deliveryAttempt(&pubsub.Message{ID: "new"}))
+	assert.Len(t, c.attempts, 1, "messages that weren't redelivered should be forgotten")
+	assert.Equal(t, 2, c.deliveryAttempt(&pubsub.Message{ID: "new"}))
+
+	c.attempts = make(map[string]*deliveryCount)
+	for i := 0; i < maxTrackedAttempts; i++ {
+		c.attempts[fmt.Sprint(i)] = &deliveryCount{count: 1, lastSeen: time.Now()}
+	}
+	assert.Equal(t, 1, c.deliveryAttempt(&pubsub.Message{ID: "other"}))
+	assert.Len(t, c.attempts, maxTrackedAttempts, "attempts should not grow past the bound")
+}
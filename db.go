@@ -1,44 +1,68 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"embed"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/mysql"
 	_ "github.com/golang-migrate/migrate/v4/database/mysql"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/golang-migrate/migrate/v4/source/github"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	log "github.com/sirupsen/logrus"
-	"os"
 	"time"
 )
 
-var dbConnString = os.Getenv("DB_CONNECTION_STRING")
+// The migrations are embedded so the binary can migrate the database on its own
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
 
-const migrationVer uint = 11
+const migrationVer uint = 14
 
-var db *sql.DB
 var hystrixDb = "db"
-var campStmt *sql.Stmt
-var addCampStmt *sql.Stmt
-var getUserTagsStmt *sql.Stmt
-var getUserExperienceLevelStmt *sql.Stmt
 
-func openDatabaseConnection() (*sql.DB, error) {
-	conn, err := sql.Open("mysql", dbConnString+"?charset=utf8mb4,utf8")
+// hystrixReplica guards the reads of the replica, which fall back to the
+// primary when it trips
+var hystrixReplica = "replica"
+
+// mysqlStore keeps the campaigns and the targeting data of the users in the
+// database, it implements all the stores. The reads of the serving path go to
+// the replica while it's healthy and the writes always go to the primary.
+type mysqlStore struct {
+	db              *sql.DB
+	addCampaignStmt *sql.Stmt
+	primary         *mysqlReadStmts
+	replica         *mysqlReadStmts
+	replicaHealth   *replicaHealth
+	// tagDecay is the decay constant per second of the interest in a tag
+	tagDecay float64
+}
+
+// mysqlReadStmts are the queries of the serving path prepared on a database
+type mysqlReadStmts struct {
+	fetchCampaigns     *sql.Stmt
+	getUserTags        *sql.Stmt
+	getExperienceLevel *sql.Stmt
+}
+
+func openDatabaseConnection(cfg DatabaseConfig) (*sql.DB, error) {
+	conn, err := sql.Open("mysql", cfg.ConnectionString+"?charset=utf8mb4,utf8")
 	if err != nil {
 		return nil, err
 	}
 
-	conn.SetConnMaxLifetime(time.Minute * 3)
-	conn.SetMaxOpenConns(20)
-	conn.SetMaxIdleConns(20)
+	conn.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	conn.SetMaxOpenConns(cfg.MaxOpenConns)
+	conn.SetMaxIdleConns(cfg.MaxIdleConns)
 
 	return conn, nil
 }
 
-func newMigrate() (*migrate.Migrate, error) {
-	con, err := openDatabaseConnection()
+func newMigrate(cfg DatabaseConfig) (*migrate.Migrate, error) {
+	con, err := openDatabaseConnection(cfg)
 	if err != nil {
 		log.Fatal("failed to open sql ", err)
 	}
@@ -46,14 +70,19 @@ func newMigrate() (*migrate.Migrate, error) {
 	if err != nil {
 		log.Fatal("failed to get driver ", err)
 	}
-	return migrate.NewWithDatabaseInstance(
-		getEnv("MIGRATIONS_SOURCE", "file://migrations"),
-		"mysql", driver)
+	if cfg.MigrationsSource != "" {
+		return migrate.NewWithDatabaseInstance(cfg.MigrationsSource, "mysql", driver)
+	}
+	source, err := iofs.New(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithInstance("iofs", source, "mysql", driver)
 }
 
-func migrateDatabase() {
+func migrateDatabase(cfg DatabaseConfig) {
 	log.Info("migrating database")
-	m, err := newMigrate()
+	m, err := newMigrate(cfg)
 	if err != nil {
 		log.Fatal("failed to connect ", err)
 	}
@@ -65,9 +94,9 @@ func migrateDatabase() {
 	}
 }
 
-func dropDatabase() {
+func dropDatabase(cfg DatabaseConfig) {
 	log.Info("dropping database")
-	m, err := newMigrate()
+	m, err := newMigrate(cfg)
 	if err != nil {
 		log.Fatal("failed to connect ", err)
 	}
@@ -79,14 +108,68 @@ func dropDatabase() {
 	}
 }
 
-func initializeDatabase() {
+// initializeDatabase opens the primary and, when it's configured, the replica,
+// the replica is nil otherwise
+func initializeDatabase(cfg DatabaseConfig) (primary *sql.DB, replica *sql.DB) {
 	var err error
-	db, err = openDatabaseConnection()
+	primary, err = openDatabaseConnection(cfg)
 	if err != nil {
 		log.Fatal("failed to open sql ", err)
 	}
 
-	campStmt, err = db.Prepare(`
+	if cfg.Replica.ConnectionString != "" {
+		replicaCfg := cfg
+		replicaCfg.ConnectionString = cfg.Replica.ConnectionString
+		replica, err = openDatabaseConnection(replicaCfg)
+		if err != nil {
+			log.Fatal("failed to open replica sql ", err)
+		}
+	}
+	return primary, replica
+}
+
+// newMySQLStore prepares the queries of the stores on the primary and, when
+// it's not nil, on the replica
+func newMySQLStore(primary *sql.DB, replica *sql.DB, cfg ReplicaConfig, tagHalfLife time.Duration) (*mysqlStore, error) {
+	s := &mysqlStore{db: primary, tagDecay: userTagDecay(tagHalfLife)}
+	var err error
+
+	s.addCampaignStmt, err = primary.Prepare(
+		"insert into `ads` " +
+			"(`id`, `title`, `url`, `image`, `ratio`, `placeholder`, `source`, " +
+			"`company`, `probability`, `fallback`, `geo`, `start`, `end`, " +
+			"`utm_source`, `utm_medium`, `utm_campaign`, `utm_content`) " +
+			"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+
+	s.primary, err = prepareReadStmts(primary)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if replica != nil {
+		s.replica, err = prepareReadStmts(replica)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.replicaHealth = newReplicaHealth(func(ctx context.Context) error {
+			return checkReplica(ctx, replica, cfg.MaxLag)
+		}, cfg.CheckInterval)
+	}
+	return s, nil
+}
+
+func prepareReadStmts(db *sql.DB) (*mysqlReadStmts, error) {
+	s := &mysqlReadStmts{}
+	var err error
+
+	// Campaigns are targeted by a list of experience levels or by a range of
+	// the experience scale
+	s.fetchCampaigns, err = db.Prepare(`
 		select id,
 		   title,
 		   url,
@@ -99,7 +182,12 @@ func initializeDatabase() {
 		   fallback,
 		   geo,
 		   tag_relevant_ads.ad_id is not null as is_tag_targeted,
-		   exp_relevant_ads.ad_id is not null as is_exp_targeted
+		   exp_relevant_ads.ad_id is not null as is_exp_targeted,
+		   price,
+		   utm_source,
+		   utm_medium,
+		   utm_campaign,
+		   utm_content
 		from ads
          	left join (select ad_id, max(relevant) as relevant  
                     from (select ad_id,
@@ -115,7 +203,17 @@ func initializeDatabase() {
                                          from user_experience_levels
                                          where user_experience_levels.experience_level = ad_experience_level.experience_level
                                            and user_experience_levels.user_id = ?) as relevant
-                          from ad_experience_level) as res
+                          from ad_experience_level
+                          union all
+                          select ad_id,
+                                 exists (select user_id
+                                         from user_experience_levels
+                                         where user_experience_levels.user_id = ?
+                                           and field(user_experience_levels.experience_level, ` + experienceScaleSql() + `) > 0
+                                           and field(user_experience_levels.experience_level, ` + experienceScaleSql() + `) >= field(ad_experience_range.min_experience_level, ` + experienceScaleSql() + `)
+                                           and (ad_experience_range.max_experience_level is null or
+                                                field(user_experience_levels.experience_level, ` + experienceScaleSql() + `) <= field(ad_experience_range.max_experience_level, ` + experienceScaleSql() + `))) as relevant
+                          from ad_experience_range) as res
                     group by ad_id) exp_relevant_ads on ads.id = exp_relevant_ads.ad_id
 		where start <= ? and end > ? and 
 		      (
@@ -128,34 +226,50 @@ func initializeDatabase() {
        			(tag_relevant_ads.relevant is null and exp_relevant_ads.relevant = 1)
     		  )`)
 	if err != nil {
-		log.Fatal("failed to prepare query ", err)
+		s.Close()
+		return nil, err
 	}
 
-	addCampStmt, err = db.Prepare(
-		"insert into `ads` " +
-			"(`id`, `title`, `url`, `image`, `ratio`, `placeholder`, `source`, " +
-			"`company`, `probability`, `fallback`, `geo`, `start`, `end`) " +
-			"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	// Rank the tags by their interest score decayed to now
+	s.getUserTags, err = db.Prepare("select tag from user_tags where user_id = ? order by score * exp(-? * timestampdiff(second, last_read, now())) desc limit 50")
 	if err != nil {
-		log.Fatal("failed to prepare query ", err)
+		s.Close()
+		return nil, err
 	}
 
-	getUserTagsStmt, err = db.Prepare("select tag from user_tags where user_id = ? order by last_read desc limit 50")
+	s.getExperienceLevel, err = db.Prepare("select experience_level from user_experience_levels where user_id = ?")
 	if err != nil {
-		log.Fatal("failed to prepare query ", err)
+		s.Close()
+		return nil, err
 	}
+	return s, nil
+}
 
-	getUserExperienceLevelStmt, err = db.Prepare("select experience_level from user_experience_levels where user_id = ?")
-	if err != nil {
-		log.Fatal("failed to prepare query ", err)
+func (s *mysqlReadStmts) Close() {
+	for _, stmt := range []*sql.Stmt{s.fetchCampaigns, s.getUserTags, s.getExperienceLevel} {
+		if stmt != nil {
+			stmt.Close()
+		}
 	}
 }
 
-func tearDatabase() {
-	addCampStmt.Close()
-	campStmt.Close()
-	getUserTagsStmt.Close()
-	getUserExperienceLevelStmt.Close()
+// Close stops the health checks and closes the prepared statements, the
+// databases are closed by their owner
+func (s *mysqlStore) Close() {
+	if s.replicaHealth != nil {
+		s.replicaHealth.stop()
+	}
+	for _, stmts := range []*mysqlReadStmts{s.primary, s.replica} {
+		if stmts != nil {
+			stmts.Close()
+		}
+	}
+	s.addCampaignStmt.Close()
+}
 
-	db.Close()
+func tearDatabase(primary *sql.DB, replica *sql.DB) {
+	if replica != nil {
+		replica.Close()
+	}
+	primary.Close()
 }
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
-	"os"
 )
 
 type EthicalAdsAd struct {
@@ -23,9 +22,8 @@ type EthicalAdsResponse struct {
 }
 
 var hystrixEa = "EthicalAds"
-var ethicaladsToken = os.Getenv("ETHICALADS_TOKEN")
 
-var fetchEthicalAds = func(r *http.Request, keywords []string) (*EthicalAdsAd, error) {
+var fetchEthicalAds = func(p *adProviders, r *http.Request, keywords []string) (*EthicalAdsAd, error) {
 	keywordsString := ""
 	for i, keyword := range keywords {
 		if i > 0 {
@@ -33,20 +31,26 @@ var fetchEthicalAds = func(r *http.Request, keywords []string) (*EthicalAdsAd, e
 		}
 		keywordsString += fmt.Sprintf("\"%s\"", keyword)
 	}
-	ip := getIpAddress(r)
+	ip := p.ipAddress(r, hystrixEa)
 	ua := r.UserAgent()
+	key := providerCacheKey(hystrixEa, "dailydev", getCountryByIP(getIpAddress(r)), tagsToSegments(keywords))
+	if cached, ok := p.lookupNoFill(r.Context(), hystrixEa, key); ok {
+		return nil, cached.err
+	}
 	var body = []byte(`{ "publisher": "dailydev", "placements": [{ "div_id": "ad-div-1", "ad_type": "image-v1" }], "campaign_types": ["paid"], "user_ip": "` + ip + `", "user_ua": "` + ua + `", "keywords": [` + keywordsString + `] }`)
 	var res EthicalAdsResponse
 	req, _ := http.NewRequest("POST", "https://server.ethicalads.io/api/v1/decision/", bytes.NewBuffer(body))
 	req.Header.Set("User-Agent", "daily.dev ad server")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Token "+ethicaladsToken)
+	req.Header.Set("Authorization", "Token "+p.ethicaladsToken)
 	req = req.WithContext(r.Context())
 	err := getJsonHystrix(hystrixEa, req, &res, true)
 	if err != nil {
+		p.rememberNoFill(key, err)
 		return nil, err
 	}
 	if res.Body == "" {
+		p.rememberNoFill(key, nil)
 		return nil, nil
 	}
 
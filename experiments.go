@@ -0,0 +1,117 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+)
+
+// The providers of the feed's waterfall, fallback campaigns are always served
+// last when none of them has an ad
+const (
+	waterfallCampaigns  = "campaigns"
+	waterfallPremium    = "premium"
+	waterfallBsa        = "bsa"
+	waterfallEthicalAds = "ethicalads"
+	waterfallOpenRTB    = "openrtb"
+	waterfallStandard   = "standard"
+)
+
+var defaultWaterfall = []string{
+	waterfallCampaigns,
+	waterfallPremium,
+	waterfallBsa,
+	waterfallEthicalAds,
+	waterfallOpenRTB,
+	waterfallStandard,
+}
+
+func isWaterfallProvider(provider string) bool {
+	for _, p := range defaultWaterfall {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// waterfall is the order in which the providers are asked for an ad of the
+// feed along with the variants of the experiments it was built from
+type waterfall struct {
+	providers         []string
+	probabilities     map[string]float64
+	segmentProperties map[string]string
+	// variants maps the experiments of the user to their variant
+	variants map[string]string
+}
+
+// assignVariant hashes the user into one of the variants of the experiment,
+// so users keep their variant as long as the experiment doesn't change. The
+// name of the experiment is part of the hash to split the users of every
+// experiment independently.
+func assignVariant(name string, experiment ExperimentConfig, userId string) (string, bool) {
+	variants := sortedKeys(experiment.Variants)
+	total := 0
+	for _, variant := range variants {
+		total += experiment.Variants[variant].Weight
+	}
+	if total <= 0 {
+		return "", false
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name + ":" + userId))
+	bucket := int(h.Sum64() % uint64(total))
+	for _, variant := range variants {
+		bucket -= experiment.Variants[variant].Weight
+		if bucket < 0 {
+			return variant, true
+		}
+	}
+	return "", false
+}
+
+// newWaterfall builds the waterfall of the user from the running experiments,
+// anonymous users aren't part of any experiment. Experiments are applied in
+// the order of their names, so a later one overrides the settings they share.
+func newWaterfall(cfg *Config, userId string) waterfall {
+	wf := waterfall{
+		providers:         defaultWaterfall,
+		probabilities:     map[string]float64{},
+		segmentProperties: cfg.Providers.Bsa.SegmentProperties,
+		variants:          map[string]string{},
+	}
+	if userId == "" {
+		return wf
+	}
+
+	for _, name := range sortedKeys(cfg.Experiments) {
+		experiment := cfg.Experiments[name]
+		if experiment.Stopped {
+			continue
+		}
+		variant, ok := assignVariant(name, experiment, userId)
+		if !ok {
+			continue
+		}
+		wf.variants[name] = variant
+
+		settings := experiment.Variants[variant]
+		if len(settings.Providers) > 0 {
+			wf.providers = settings.Providers
+		}
+		for provider, probability := range settings.Probabilities {
+			wf.probabilities[provider] = probability
+		}
+		if len(settings.SegmentProperties) > 0 {
+			wf.segmentProperties = settings.SegmentProperties
+		}
+	}
+	return wf
+}
+
+// asks tells whether the provider should be asked for an ad, providers are
+// always asked unless a variant sets their probability
+func (wf waterfall) asks(provider string) bool {
+	probability, ok := wf.probabilities[provider]
+	return !ok || rand.Float64() < probability
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testExperiment = ExperimentConfig{
+	Variants: map[string]VariantConfig{
+		"control": {Weight: 3},
+		"ethicalFirst": {
+			Weight:        1,
+			Providers:     []string{waterfallEthicalAds, waterfallBsa},
+			Probabilities: map[string]float64{waterfallBsa: 0.5},
+		},
+	},
+}
+
+func TestAssignVariant(t *testing.T) {
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		userId := fmt.Sprintf("user%d", i)
+		variant, ok := assignVariant("order", testExperiment, userId)
+		require.True(t, ok)
+		again, _ := assignVariant("order", testExperiment, userId)
+		assert.Equal(t, variant, again, "users should keep their variant")
+		counts[variant]++
+	}
+	assert.InDelta(t, 3000, counts["control"], 200)
+	assert.InDelta(t, 1000, counts["ethicalFirst"], 200)
+
+	_, ok := assignVariant("order", ExperimentConfig{}, "user")
+	assert.False(t, ok, "experiments without variants assign no one")
+}
+
+func TestExperimentWaterfall(t *testing.T) {
+	cfg := *testConfig
+	cfg.Experiments = map[string]ExperimentConfig{
+		"order": {Variants: map[string]VariantConfig{"test": testExperiment.Variants["ethicalFirst"]}},
+		"segments": {Variants: map[string]VariantConfig{
+			"test": {Weight: 1, SegmentProperties: map[string]string{"golang": "GOLANG"}},
+		}},
+	}
+
+	wf := newWaterfall(&cfg, "user")
+	assert.Equal(t, []string{waterfallEthicalAds, waterfallBsa}, wf.providers)
+	assert.Equal(t, map[string]float64{waterfallBsa: 0.5}, wf.probabilities)
+	assert.Equal(t, map[string]string{"golang": "GOLANG"}, wf.segmentProperties)
+	assert.Equal(t, map[string]string{"order": "test", "segments": "test"}, wf.variants)
+	assert.True(t, wf.asks(waterfallEthicalAds))
+
+	wf = newWaterfall(&cfg, "")
+	assert.Equal(t, defaultWaterfall, wf.providers, "anonymous users get the default waterfall")
+	assert.Empty(t, wf.variants)
+
+	cfg.Experiments = map[string]ExperimentConfig{
+		"order": {Stopped: true, Variants: map[string]VariantConfig{"test": testExperiment.Variants["ethicalFirst"]}},
+	}
+	wf = newWaterfall(&cfg, "user")
+	assert.Equal(t, defaultWaterfall, wf.providers, "stopped experiments get the default waterfall")
+	assert.Equal(t, cfg.Providers.Bsa.SegmentProperties, wf.segmentProperties)
+	assert.Empty(t, wf.variants)
+}
+
+func TestExperimentServesVariant(t *testing.T) {
+	stores := newTestStores()
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		return nil, nil
+	})
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
+		return &BsaAd{Ad: Ad{Company: "bsa"}}, nil
+	}
+	fetchEthicalAds = func(_ *adProviders, r *http.Request, keywords []string) (*EthicalAdsAd, error) {
+		return &EthicalAdsAd{Ad: Ad{Company: "ethicalads"}}, nil
+	}
+
+	cfg := *testConfig
+	cfg.Experiments = map[string]ExperimentConfig{
+		"order": {Variants: map[string]VariantConfig{
+			"ethicalFirst": {Weight: 1, Providers: []string{waterfallEthicalAds, waterfallBsa}},
+		}},
+	}
+	serve := func(cfg *Config) string {
+		req, err := http.NewRequest("GET", "/a", nil)
+		require.NoError(t, err)
+		setBrowserHeaders(req)
+		req.AddCookie(&http.Cookie{Name: "da2", Value: "1"})
+		rr := httptest.NewRecorder()
+		createApp(cfg, stores).ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var actual []Ad
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
+		require.Len(t, actual, 1)
+		return actual[0].Company
+	}
+
+	assert.Equal(t, "ethicalads", serve(&cfg))
+	assert.Equal(t, "bsa", serve(testConfig))
+}
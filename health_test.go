@@ -15,7 +15,7 @@ func TestHealthCheck(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, newTestStores())
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, rr.Code, http.StatusOK, "wrong status code")
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+var hystrixConfigs = map[string]hystrix.CommandConfig{}
+
+// configuredBreakers maps the breakers of the properties to their provider
+var configuredBreakers = map[string]string{}
+var breakersMutex sync.Mutex
+
+// configureHystrix applies the breakers of the config to the hystrix registry,
+// which is shared by the whole process, the apps call it when they're created.
+// The breakers of the properties that were already used get the new settings
+// of their provider too.
+func configureHystrix(breakers map[string]BreakerConfig) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	for provider, breaker := range breakers {
+		hystrixConfigs[provider] = hystrix.CommandConfig{
+			Timeout:                breaker.Timeout,
+			MaxConcurrentRequests:  breaker.MaxConcurrentRequests,
+			RequestVolumeThreshold: breaker.RequestVolumeThreshold,
+			SleepWindow:            breaker.SleepWindow,
+			ErrorPercentThreshold:  breaker.ErrorPercentThreshold,
+		}
+		hystrix.ConfigureCommand(provider, hystrixConfigs[provider])
+	}
+	for name, provider := range configuredBreakers {
+		if _, ok := breakers[provider]; ok {
+			hystrix.ConfigureCommand(name, hystrixConfigs[provider])
+		}
+	}
+}
+
+// providerBreaker returns the name of a dedicated breaker for one of the
+// provider's properties, so a failing property doesn't open the circuit for
+// the rest. The breaker is configured with the provider settings on first use.
+func providerBreaker(provider string, key string) string {
+	name := provider + ":" + key
+
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	if _, ok := configuredBreakers[name]; !ok {
+		hystrix.ConfigureCommand(name, hystrixConfigs[provider])
+		configuredBreakers[name] = provider
+	}
+	return name
+}
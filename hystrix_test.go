@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderBreaker(t *testing.T) {
+	configureHystrix(testConfig.Hystrix)
+	first := providerBreaker(hystrixBsa, "CK7DT2QM")
+	second := providerBreaker(hystrixBsa, "CW7D52QL")
+	assert.Equal(t, "BSA:CK7DT2QM", first)
+	assert.NotEqual(t, first, second)
+
+	settings := hystrix.GetCircuitSettings()
+	assert.Equal(t, time.Duration(hystrixConfigs[hystrixBsa].Timeout)*time.Millisecond, settings[first].Timeout)
+	assert.Equal(t, settings[first], settings[second])
+}
+
+func TestProviderBreakerReconfigured(t *testing.T) {
+	configureHystrix(testConfig.Hystrix)
+	defer configureHystrix(testConfig.Hystrix)
+	name := providerBreaker(hystrixEa, "reconfigured")
+
+	breaker := testConfig.Hystrix[hystrixEa]
+	breaker.Timeout = 42
+	configureHystrix(map[string]BreakerConfig{hystrixEa: breaker})
+
+	assert.Equal(t, 42*time.Millisecond, hystrix.GetCircuitSettings()[name].Timeout, "existing breakers should get the new settings")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type hostRewrite struct {
+	from string
+	to   string
+}
+
+// imagePipeline rewrites the image urls of the ads we serve. The host rewrites
+// apply to every image, so the images of any provider can be moved to our
+// CDN, while the transformations of the placement only apply to the images
+// served by Cloudinary, which resizes and converts them on the fly.
+type imagePipeline struct {
+	// rewrites are ordered by the longest prefix first, so the most
+	// specific rule wins
+	rewrites        []hostRewrite
+	cloudinaryHosts map[string]bool
+	maxDpr          float64
+	placements      map[string]ImageTransform
+}
+
+func newImagePipeline(cfg ImagesConfig) *imagePipeline {
+	p := &imagePipeline{
+		cloudinaryHosts: make(map[string]bool, len(cfg.CloudinaryHosts)),
+		maxDpr:          cfg.MaxDpr,
+		placements:      cfg.Placements,
+	}
+	for from, to := range cfg.HostRewrites {
+		p.rewrites = append(p.rewrites, hostRewrite{from: strings.TrimSuffix(from, "/"), to: strings.TrimSuffix(to, "/")})
+	}
+	sort.Slice(p.rewrites, func(i, j int) bool {
+		if len(p.rewrites[i].from) != len(p.rewrites[j].from) {
+			return len(p.rewrites[i].from) > len(p.rewrites[j].from)
+		}
+		return p.rewrites[i].from < p.rewrites[j].from
+	})
+	for _, host := range cfg.CloudinaryHosts {
+		p.cloudinaryHosts[host] = true
+	}
+	return p
+}
+
+// rewriteHost replaces the host, and the path prefix of the rule when it has
+// one, by the first rule that matches the url
+func (p *imagePipeline) rewriteHost(u *url.URL) {
+	hostPath := u.Host + u.Path
+	for _, rule := range p.rewrites {
+		rest, found := strings.CutPrefix(hostPath, rule.from)
+		if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+		host, path, _ := strings.Cut(rule.to, "/")
+		u.Host = host
+		if path != "" {
+			path = "/" + path
+		}
+		u.Path = path + rest
+		u.RawPath = ""
+		return
+	}
+}
+
+// cloudinaryTransformRegex matches the path components of the chained
+// transformations that may follow the delivery type, e.g. w_400,c_fill
+var cloudinaryTransformRegex = regexp.MustCompile(`^[a-z]{1,3}_[^,/]+(?:,[a-z]{1,3}_[^,/]+)*$`)
+
+// cloudinaryVersionRegex matches the version component that ends the
+// transformations when the url has one
+var cloudinaryVersionRegex = regexp.MustCompile(`^v[0-9]+$`)
+
+// transformation returns the Cloudinary transformation of the placement for
+// the device pixel ratio, dpr 0 leaves it to Cloudinary
+func (p *imagePipeline) transformation(placement string, dpr float64) string {
+	transform, ok := p.placements[placement]
+	if !ok {
+		return ""
+	}
+	var params []string
+	if transform.Width > 0 {
+		params = append(params, fmt.Sprintf("w_%d", transform.Width))
+		// The pixel ratio only matters when the image is resized
+		if dpr > 0 {
+			params = append(params, fmt.Sprintf("dpr_%.1f", dpr))
+		}
+	}
+	if transform.Format != "" {
+		params = append(params, "f_"+transform.Format)
+	}
+	if transform.Quality != "" {
+		params = append(params, "q_"+transform.Quality)
+	}
+	return strings.Join(params, ",")
+}
+
+// addTransformation chains the transformation after the existing ones of a
+// Cloudinary delivery url, like /image/upload/v1/image.png, urls of other
+// kinds are left as is
+func addTransformation(u *url.URL, transformation string) {
+	components := strings.Split(u.Path, "/")
+	for i := 1; i < len(components)-1; i++ {
+		if components[i] != "upload" && components[i] != "fetch" {
+			continue
+		}
+		at := i + 1
+		for at < len(components)-1 && !cloudinaryVersionRegex.MatchString(components[at]) &&
+			cloudinaryTransformRegex.MatchString(components[at]) {
+			at++
+		}
+		components = append(components[:at], append([]string{transformation}, components[at:]...)...)
+		u.Path = strings.Join(components, "/")
+		u.RawPath = ""
+		return
+	}
+}
+
+// apply returns the url of the image for the placement and the device pixel
+// ratio, unknown placements only get the host rewrites
+func (p *imagePipeline) apply(image string, placement string, dpr float64) string {
+	u, err := url.Parse(image)
+	if err != nil || u.Host == "" {
+		return image
+	}
+	p.rewriteHost(u)
+	if p.cloudinaryHosts[u.Host] {
+		if transformation := p.transformation(placement, dpr); transformation != "" {
+			addTransformation(u, transformation)
+		}
+	}
+	return u.String()
+}
+
+// applyAds applies the pipeline to the image of every ad
+func (p *imagePipeline) applyAds(res []interface{}, placement string, dpr float64) {
+	for i, ad := range res {
+		switch ad := ad.(type) {
+		case CampaignAd:
+			ad.Image = p.apply(ad.Image, placement, dpr)
+			res[i] = ad
+		case BsaAd:
+			ad.Image = p.apply(ad.Image, placement, dpr)
+			res[i] = ad
+		case EthicalAdsAd:
+			ad.Image = p.apply(ad.Image, placement, dpr)
+			res[i] = ad
+		case OpenRTBAd:
+			ad.Image = p.apply(ad.Image, placement, dpr)
+			res[i] = ad
+		}
+	}
+}
+
+// requestDpr reads the device pixel ratio from the dpr query parameter,
+// rounded to a tenth and capped by the pipeline. It's 0 when the parameter is
+// missing or invalid.
+func (p *imagePipeline) requestDpr(r *http.Request) float64 {
+	dpr, err := strconv.ParseFloat(r.URL.Query().Get("dpr"), 64)
+	if err != nil || math.IsNaN(dpr) || dpr <= 0 {
+		return 0
+	}
+	dpr = math.Round(dpr*10) / 10
+	return math.Max(1, math.Min(dpr, p.maxDpr))
+}
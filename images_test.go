@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testImages = ImagesConfig{
+	HostRewrites: map[string]string{
+		"res.cloudinary.com/daily-now": "media.daily.dev",
+		"cdn.example.com":              "images.example.com/cdn",
+	},
+	CloudinaryHosts: []string{"media.daily.dev"},
+	MaxDpr:          3,
+	Placements: map[string]ImageTransform{
+		"feed": {Width: 400, Format: "auto", Quality: "auto"},
+		"post": {Format: "auto"},
+	},
+}
+
+func TestImagePipeline(t *testing.T) {
+	images := newImagePipeline(testImages)
+	tests := []struct {
+		name      string
+		image     string
+		placement string
+		dpr       float64
+		expected  string
+	}{
+		{"rewrites cloudinary", "https://res.cloudinary.com/daily-now/image/upload/v1/ads/a.png", "post", 0, "https://media.daily.dev/image/upload/f_auto/v1/ads/a.png"},
+		{"adds the width and dpr", "https://media.daily.dev/image/upload/v1/a.png", "feed", 2, "https://media.daily.dev/image/upload/w_400,dpr_2.0,f_auto,q_auto/v1/a.png"},
+		{"chains existing transformations", "https://media.daily.dev/image/upload/c_fill,h_200/a.png", "post", 0, "https://media.daily.dev/image/upload/c_fill,h_200/f_auto/a.png"},
+		{"rewrites other hosts", "https://cdn.example.com/a.png", "feed", 0, "https://images.example.com/cdn/a.png"},
+		{"matches whole path components", "https://res.cloudinary.com/daily-now-other/a.png", "feed", 0, "https://res.cloudinary.com/daily-now-other/a.png"},
+		{"leaves other urls", "https://srv.buysellads.com/a.png", "feed", 2, "https://srv.buysellads.com/a.png"},
+		{"unknown placement only rewrites", "https://res.cloudinary.com/daily-now/image/upload/a.png", "", 2, "https://media.daily.dev/image/upload/a.png"},
+		{"leaves invalid urls", "image", "feed", 0, "image"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, images.apply(test.image, test.placement, test.dpr))
+		})
+	}
+}
+
+func TestImagePipelineDpr(t *testing.T) {
+	images := newImagePipeline(testImages)
+	for query, expected := range map[string]float64{
+		"":          0,
+		"?dpr=abc":  0,
+		"?dpr=-1":   0,
+		"?dpr=0.5":  1,
+		"?dpr=1.5":  1.5,
+		"?dpr=2.25": 2.3,
+		"?dpr=10":   3,
+	} {
+		req := httptest.NewRequest("GET", "/a"+query, nil)
+		assert.Equal(t, expected, images.requestDpr(req), query)
+	}
+}
+
+func TestCampaignImageTransformed(t *testing.T) {
+	stores := newTestStores()
+	fetchEthicalAds = ethicalNotAvailable
+	fetchBsa = bsaNotAvailable
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		camp := CampaignAd{Ad: ad, Id: "id", Probability: 1}
+		camp.Image = "https://res.cloudinary.com/daily-now/image/upload/v1/a.png"
+		return []CampaignAd{camp}, nil
+	})
+
+	req, err := http.NewRequest("GET", "/a?dpr=2", nil)
+	require.NoError(t, err)
+	setBrowserHeaders(req)
+	rr := httptest.NewRecorder()
+	cfg := *testConfig
+	cfg.Images = testImages
+	createApp(&cfg, stores).ServeHTTP(rr, req)
+
+	var actual []CampaignAd
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
+	require.Len(t, actual, 1)
+	assert.Equal(t, "https://media.daily.dev/image/upload/w_400,dpr_2.0,f_auto,q_auto/v1/a.png", actual[0].Image)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ivtVerdict tells whether a request is likely invalid traffic, in which case
+// only house ads are served to protect our standing with the ad networks
+type ivtVerdict struct {
+	Flagged bool
+	Reason  string
+}
+
+type ivtKey struct{}
+
+// ivtDetector flags the requests of bots and datacenters with the lists of
+// the config. The ip is the one the trusted proxies saw, like the rate
+// limiter's, since the client controls the start of X-Forwarded-For.
+type ivtDetector struct {
+	botPatterns      []string
+	datacenterRanges []*net.IPNet
+	trustedProxies   int
+}
+
+func newIvtDetector(cfg IvtConfig, trustedProxies int) *ivtDetector {
+	return &ivtDetector{
+		botPatterns:      readIvtList(cfg.BotList),
+		datacenterRanges: parseIvtRanges(readIvtList(cfg.DatacenterRanges)),
+		trustedProxies:   trustedProxies,
+	}
+}
+
+// readIvtList reads the non-empty lines of the file, skipping # comments
+func readIvtList(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Warn("failed to open ivt list ", err)
+		return nil
+	}
+	defer file.Close()
+
+	var res []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			res = append(res, strings.ToLower(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warn("failed to read ivt list ", err)
+	}
+	return res
+}
+
+func parseIvtRanges(values []string) []*net.IPNet {
+	var res []*net.IPNet
+	for _, value := range values {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Warn("invalid datacenter range ", value)
+			continue
+		}
+		res = append(res, ipNet)
+	}
+	return res
+}
+
+func (d *ivtDetector) isDatacenterIp(ip string) bool {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range d.datacenterRanges {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *ivtDetector) verdict(r *http.Request) ivtVerdict {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return ivtVerdict{Flagged: true, Reason: "missing_user_agent"}
+	}
+	for _, pattern := range d.botPatterns {
+		if strings.Contains(ua, pattern) {
+			return ivtVerdict{Flagged: true, Reason: "bot_user_agent"}
+		}
+	}
+	// Browsers always send their languages, most scripts don't bother
+	if r.Header.Get("Accept-Language") == "" {
+		return ivtVerdict{Flagged: true, Reason: "missing_accept_language"}
+	}
+	if d.isDatacenterIp(clientIpAddress(r, d.trustedProxies)) {
+		return ivtVerdict{Flagged: true, Reason: "datacenter"}
+	}
+	return ivtVerdict{}
+}
+
+func (d *ivtDetector) withVerdict(r *http.Request) *http.Request {
+	verdict := d.verdict(r)
+	recordIvtVerdict(r.Context(), verdict)
+	if verdict.Flagged {
+		log.WithField("reason", verdict.Reason).WithField("userAgent", r.UserAgent()).Info("serving house ads only to invalid traffic")
+	}
+	return r.WithContext(context.WithValue(r.Context(), ivtKey{}, verdict))
+}
+
+func ivtFromContext(ctx context.Context) ivtVerdict {
+	if v, ok := ctx.Value(ivtKey{}).(ivtVerdict); ok {
+		return v
+	}
+	return ivtVerdict{}
+}
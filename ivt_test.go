@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const browserUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// setBrowserHeaders makes the request look like it was sent by a browser so
+// it passes the invalid traffic filter
+func setBrowserHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", browserUserAgent)
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+}
+
+func TestReadIvtList(t *testing.T) {
+	assert.Contains(t, readIvtList("./ivt/bots.txt"), "googlebot")
+	assert.Nil(t, readIvtList("./ivt/missing.txt"))
+	assert.Len(t, parseIvtRanges([]string{"10.0.0.0/8", "invalid", "2001:db8::/32"}), 2)
+}
+
+func TestIvtVerdict(t *testing.T) {
+	detector := newIvtDetector(testConfig.Ivt, 1)
+	detector.datacenterRanges = parseIvtRanges([]string{"203.0.113.0/24"})
+
+	cases := []struct {
+		name     string
+		headers  map[string]string
+		expected ivtVerdict
+	}{
+		{name: "browser", expected: ivtVerdict{}},
+		{name: "missing user agent", headers: map[string]string{"User-Agent": ""}, expected: ivtVerdict{Flagged: true, Reason: "missing_user_agent"}},
+		{name: "crawler", headers: map[string]string{"User-Agent": "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"}, expected: ivtVerdict{Flagged: true, Reason: "bot_user_agent"}},
+		{name: "headless", headers: map[string]string{"User-Agent": "Mozilla/5.0 HeadlessChrome/120.0.0.0"}, expected: ivtVerdict{Flagged: true, Reason: "bot_user_agent"}},
+		{name: "uptime checker", headers: map[string]string{"User-Agent": "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)"}, expected: ivtVerdict{Flagged: true, Reason: "bot_user_agent"}},
+		{name: "missing accept language", headers: map[string]string{"Accept-Language": ""}, expected: ivtVerdict{Flagged: true, Reason: "missing_accept_language"}},
+		{name: "datacenter", headers: map[string]string{"x-forwarded-for": "203.0.113.7"}, expected: ivtVerdict{Flagged: true, Reason: "datacenter"}},
+		// The client prepends a residential ip to the address the proxy saw
+		{name: "forged forwarded for", headers: map[string]string{"x-forwarded-for": "8.8.8.8, 203.0.113.7"}, expected: ivtVerdict{Flagged: true, Reason: "datacenter"}},
+		{name: "forged datacenter", headers: map[string]string{"x-forwarded-for": "203.0.113.7, 8.8.8.8"}, expected: ivtVerdict{}},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/a", nil)
+		assert.Nil(t, err)
+		setBrowserHeaders(req)
+		for key, value := range c.headers {
+			req.Header.Set(key, value)
+		}
+		assert.Equal(t, c.expected, detector.verdict(req), c.name)
+	}
+}
+
+func TestInvalidTrafficServedHouseAds(t *testing.T) {
+	stores := newTestStores()
+	stores.UserTags = userTagsFunc(func(ctx context.Context, userId string) ([]string, error) {
+		t.Fatal("user tags should not be loaded")
+		return nil, nil
+	})
+	defer func() {
+		fetchBsa = originalFetchBsa
+		fetchEthicalAds = originalFetchEthicalAds
+	}()
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		return []CampaignAd{
+			{
+				Ad:          ad,
+				Id:          "id",
+				Placeholder: "placeholder",
+				Ratio:       0.5,
+				Fallback:    true,
+				Probability: 1,
+			},
+		}, nil
+	})
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
+		t.Fatal("bsa should not be called")
+		return nil, nil
+	}
+	fetchEthicalAds = func(_ *adProviders, r *http.Request, keywords []string) (*EthicalAdsAd, error) {
+		t.Fatal("ethicalads should not be called")
+		return nil, nil
+	}
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	req.Header.Set("User-Agent", "curl/8.4.0")
+
+	rr := httptest.NewRecorder()
+	router := createApp(testConfig, stores)
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
+	var actual []CampaignAd
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
+	assert.Equal(t, []CampaignAd{{Ad: servedAd("id"), Id: "id", Placeholder: "placeholder", Ratio: 0.5}}, actual)
+}
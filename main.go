@@ -2,34 +2,28 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
-	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
-	"github.com/afex/hystrix-go/hystrix"
 	log "github.com/sirupsen/logrus"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
 	_ "go.uber.org/automaxprocs"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/option"
-
-	"github.com/dailydotdev/platform-go-common/util"
 )
 
 var gcpOpts []option.ClientOption
-var segmentToId = map[string]string{
-	"python":       "CW7D52QL",
-	"design-tools": "CW7DEK3M",
-}
-var pubsubClient *pubsub.Client = nil
+var exporter *stackdriver.Exporter
 
 var pythonTags = []string{"django", "fastapi", "flask", "jupyter", "keras", "matplotlib", "numpy", "pandas", "pip", "plotly", "pyspark", "python", "pytorch", "scikit", "selenium", "tensorflow"}
 var designToolsTags = []string{
@@ -71,22 +65,24 @@ func tagsToSegments(tags []string) string {
 	return ""
 }
 
-func getBsaAd(r *http.Request, country string, tags []string, active bool) (*BsaAd, error) {
+func getBsaAd(providers *adProviders, r *http.Request, properties BsaConfig, country string, tags []string, experienceLevel string, active bool) (*BsaAd, error) {
 	var bsa *BsaAd
 	var err error
 
 	segment := tagsToSegments(tags)
-	propertyId, exists := segmentToId[segment]
+	propertyId, exists := properties.SegmentProperties[segment]
+	experiencePropertyId, experienceExists := properties.ExperienceProperties[experienceLevel]
+	countryPropertyId, countryExists := properties.CountryProperties[country]
 	if exists {
-		bsa, err = fetchBsa(r, propertyId)
+		bsa, err = fetchBsa(providers, r, propertyId)
+	} else if experienceExists {
+		bsa, err = fetchBsa(providers, r, experiencePropertyId)
 	} else if active {
-		bsa, err = fetchBsa(r, "CEAIP23E")
-	} else if country == "united states" {
-		bsa, err = fetchBsa(r, "CK7DT2QM")
-	} else if country == "united kingdom" {
-		bsa, err = fetchBsa(r, "CEAD62QI")
+		bsa, err = fetchBsa(providers, r, properties.ActiveProperty)
+	} else if countryExists {
+		bsa, err = fetchBsa(providers, r, countryPropertyId)
 	} else {
-		bsa, err = fetchBsa(r, "CK7DT2QM")
+		bsa, err = fetchBsa(providers, r, properties.DefaultProperty)
 	}
 	if err != nil {
 		log.Warn("failed to fetch ad from BSA ", err)
@@ -94,79 +90,158 @@ func getBsaAd(r *http.Request, country string, tags []string, active bool) (*Bsa
 	return bsa, err
 }
 
-func ServeAd(w http.ResponseWriter, r *http.Request) {
+// getUserTargeting loads the tags and the experience level of the user in
+// parallel, errors are logged and leave the user untargeted. Profiles are
+// cached only when both were loaded.
+func getUserTargeting(ctx context.Context, stores Stores, profiles *profileCache, userId string) ([]string, string) {
+	profile, load, ok := profiles.get(userId)
+	if ok {
+		return profile.tags, profile.experienceLevel
+	}
+	if load.primary {
+		ctx = withPrimaryRead(ctx)
+	}
+
+	experienceLevel := make(chan string, 1)
+	experienceErr := make(chan error, 1)
+	go func() {
+		if userId == "" {
+			experienceLevel <- "UNKNOWN"
+			experienceErr <- nil
+			return
+		}
+		level, err := stores.ExperienceLevels.GetExperienceLevel(ctx, userId)
+		if err != nil {
+			log.Warnln("GetExperienceLevel", err)
+		}
+		experienceLevel <- level
+		experienceErr <- err
+	}()
+
+	tags, err := stores.UserTags.GetUserTags(ctx, userId)
+	if err != nil {
+		log.Warnln("GetUserTags", err)
+	}
+	profile = userProfile{tags: tags, experienceLevel: <-experienceLevel}
+	if err == nil && <-experienceErr == nil && userId != "" {
+		profiles.set(userId, profile, load)
+	}
+	return profile.tags, profile.experienceLevel
+}
+
+func adProviderId(res []interface{}) string {
+	if len(res) == 0 {
+		return ""
+	}
+	switch ad := res[0].(type) {
+	case CampaignAd:
+		return ad.ProviderId
+	case BsaAd:
+		return ad.ProviderId
+	case EthicalAdsAd:
+		return ad.ProviderId
+	case OpenRTBAd:
+		return ad.ProviderId
+	}
+	return ""
+}
+
+func ServeAd(w http.ResponseWriter, r *http.Request, cfg *Config, stores Stores, providers *adProviders, profiles *profileCache, images *imagePipeline, utm *utmDecorator) {
 	var err error
 	var res []interface{}
 
 	ip := getIpAddress(r)
 	country := getCountryByIP(ip)
 	active := r.URL.Query().Get("active") == "true"
+	// Without consent the user is anonymous, so no targeting data is used
+	personalized := consentFromContext(r.Context()).Personalized
+	// Invalid traffic is only served house ads, so no provider is called
+	houseOnly := ivtFromContext(r.Context()).Flagged
 	var userId string
 	cookie, _ := r.Cookie("da2")
-	if cookie != nil {
+	if cookie != nil && personalized {
 		userId = cookie.Value
 	}
 
-	camps := make([]CampaignAd, 0)
-
-	if res == nil {
-		camps, err = fetchCampaigns(r.Context(), time.Now(), userId)
-		if err != nil {
-			log.Warn("failed to fetch campaigns ", err)
-		}
-
-		// Look for a campaign ad based on probability
-		prob := rand.Float32()
-		for i := 0; i < len(camps); i++ {
-			if !camps[i].Fallback && (len(camps[i].Geo) == 0 || strings.Contains(camps[i].Geo, country)) {
-				if prob <= camps[i].Probability {
-					res = []interface{}{camps[i]}
-					break
+	camps, err := stores.Campaigns.FetchCampaigns(r.Context(), time.Now(), userId)
+	if err != nil {
+		log.Warn("failed to fetch campaigns ", err)
+	}
+
+	var tags []string
+	experienceLevel := "UNKNOWN"
+	if personalized && !houseOnly {
+		tags, experienceLevel = getUserTargeting(r.Context(), stores, profiles, userId)
+	}
+	// Third-party demand is targeted by seniority along with the tags
+	keywords := tags
+	if seniority, ok := experienceSeniority[experienceLevel]; ok {
+		keywords = append(append([]string{}, tags...), seniority)
+	}
+
+	// Experiments may change the order of the providers, their chance to be
+	// asked and the segments of BSA
+	wf := newWaterfall(cfg, userId)
+	bsaProperties := cfg.Providers.Bsa
+	bsaProperties.SegmentProperties = wf.segmentProperties
+	for _, provider := range wf.providers {
+		if res != nil {
+			break
+		}
+		if (houseOnly && provider != waterfallCampaigns) || !wf.asks(provider) {
+			continue
+		}
+
+		switch provider {
+		case waterfallCampaigns:
+			// Look for a campaign ad based on probability
+			prob := rand.Float32()
+			for i := 0; i < len(camps); i++ {
+				if !camps[i].Fallback && camps[i].servedIn(country) {
+					if prob <= camps[i].Probability {
+						res = []interface{}{camps[i]}
+						break
+					}
+					prob -= camps[i].Probability
 				}
-				prob -= camps[i].Probability
 			}
-		}
-	}
-
-	// Premium self-serve
-	if res == nil {
-		bsa, err := fetchBsa(r, "CEBI62JM")
-		if err != nil {
-			log.Warn("failed to fetch ad from premium self-serve ", err)
-		} else if bsa != nil {
-			bsa.ProviderId = "premium"
-			res = []interface{}{*bsa}
-		}
-	}
-
-	tags, err := getUserTags(r.Context(), userId)
-	if err != nil {
-		log.Warnln("getUserTags", err)
-	}
-
-	if res == nil {
-		bsa, _ := getBsaAd(r, country, tags, active)
-		if bsa != nil {
-			res = []interface{}{*bsa}
-		}
-	}
-	if res == nil {
-		cf, err := fetchEthicalAds(r, tags)
-		if err != nil {
-			log.Warn("failed to fetch ad from EthicalAds ", err)
-		} else if cf != nil {
-			res = []interface{}{*cf}
-		}
-	}
-
-	// Standard self-serve
-	if res == nil {
-		bsa, err := fetchBsa(r, "CEBI62J7")
-		if err != nil {
-			log.Warn("failed to fetch ad from standard self-serve ", err)
-		} else if bsa != nil {
-			bsa.ProviderId = "standard"
-			res = []interface{}{*bsa}
+		case waterfallPremium:
+			// Premium self-serve
+			bsa, err := fetchBsa(providers, r, bsaProperties.PremiumProperty)
+			if err != nil {
+				log.Warn("failed to fetch ad from premium self-serve ", err)
+			} else if bsa != nil {
+				bsa.ProviderId = "premium"
+				res = []interface{}{*bsa}
+			}
+		case waterfallBsa:
+			bsa, _ := getBsaAd(providers, r, bsaProperties, country, tags, experienceLevel, active)
+			if bsa != nil {
+				res = []interface{}{*bsa}
+			}
+		case waterfallEthicalAds:
+			cf, err := fetchEthicalAds(providers, r, keywords)
+			if err != nil {
+				log.Warn("failed to fetch ad from EthicalAds ", err)
+			} else if cf != nil {
+				res = []interface{}{*cf}
+			}
+		case waterfallOpenRTB:
+			rtb, err := fetchOpenRTB(providers, r, keywords)
+			if err != nil {
+				log.Warn("failed to fetch ad from OpenRTB ", err)
+			} else if rtb != nil {
+				res = []interface{}{*rtb}
+			}
+		case waterfallStandard:
+			// Standard self-serve
+			bsa, err := fetchBsa(providers, r, bsaProperties.StandardProperty)
+			if err != nil {
+				log.Warn("failed to fetch ad from standard self-serve ", err)
+			} else if bsa != nil {
+				bsa.ProviderId = "standard"
+				res = []interface{}{*bsa}
+			}
 		}
 	}
 
@@ -174,7 +249,7 @@ func ServeAd(w http.ResponseWriter, r *http.Request) {
 		// Look for a fallback campaign ad based on probability
 		prob := rand.Float32()
 		for i := 0; i < len(camps); i++ {
-			if camps[i].Fallback && (len(camps[i].Geo) == 0 || strings.Contains(country, camps[i].Geo)) {
+			if camps[i].Fallback && camps[i].servedIn(country) {
 				if prob <= camps[i].Probability {
 					res = []interface{}{camps[i]}
 					break
@@ -184,10 +259,21 @@ func ServeAd(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	log.WithFields(log.Fields{
+		"provider":        adProviderId(res),
+		"country":         country,
+		"experienceLevel": experienceLevel,
+		"personalized":    personalized,
+		"invalidTraffic":  houseOnly,
+		"experiments":     wf.variants,
+	}).Info("ad decision")
+
 	if res == nil {
 		log.Info("no ads to serve for extension")
 		res = []interface{}{}
 	}
+	images.applyAds(res, "feed", images.requestDpr(r))
+	utm.decorateAds(res, "feed")
 
 	js, err := marshalJSON(res)
 	if err != nil {
@@ -200,19 +286,23 @@ func ServeAd(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
-func ServePostAd(w http.ResponseWriter, r *http.Request) {
+func ServePostAd(w http.ResponseWriter, r *http.Request, cfg *Config, providers *adProviders, images *imagePipeline, utm *utmDecorator) {
 	var err error
 	var res []interface{}
 
-	bsa, _ := fetchBsa(r, "CW7D623L")
-	if bsa != nil {
-		res = []interface{}{*bsa}
+	if !ivtFromContext(r.Context()).Flagged {
+		bsa, _ := fetchBsa(providers, r, cfg.Providers.Bsa.PostProperty)
+		if bsa != nil {
+			res = []interface{}{*bsa}
+		}
 	}
 
 	if res == nil {
 		log.Info("no ads to serve for post page")
 		res = []interface{}{}
 	}
+	images.applyAds(res, "post", images.requestDpr(r))
+	utm.decorateAds(res, "post")
 
 	js, err := marshalJSON(res)
 	if err != nil {
@@ -225,20 +315,24 @@ func ServePostAd(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
-func ServeToilet(w http.ResponseWriter, r *http.Request) {
+func ServeToilet(w http.ResponseWriter, r *http.Request, cfg *Config, providers *adProviders, images *imagePipeline, utm *utmDecorator) {
 	var res []interface{}
 
-	bsa, err := fetchBsa(r, "CK7DT2QM")
-	if err != nil {
-		log.Warn("failed to fetch ad from BSA ", err)
-	} else if bsa != nil {
-		res = []interface{}{*bsa}
+	if !ivtFromContext(r.Context()).Flagged {
+		bsa, err := fetchBsa(providers, r, cfg.Providers.Bsa.ToiletProperty)
+		if err != nil {
+			log.Warn("failed to fetch ad from BSA ", err)
+		} else if bsa != nil {
+			res = []interface{}{*bsa}
+		}
 	}
 
 	if res == nil {
 		log.Info("no ads to serve for toilet")
 		res = []interface{}{}
 	}
+	images.applyAds(res, "toilet", images.requestDpr(r))
+	utm.decorateAds(res, "toilet")
 
 	js, err := marshalJSON(res)
 	if err != nil {
@@ -251,8 +345,14 @@ func ServeToilet(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
-func ServeBsa(w http.ResponseWriter, r *http.Request) {
-	res, err := sendBsaRequest(r, "CK7DT2QM")
+func ServeBsa(w http.ResponseWriter, r *http.Request, cfg *Config, providers *adProviders) {
+	if ivtFromContext(r.Context()).Flagged {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+
+	res, err := sendBsaRequest(providers, r, cfg.Providers.Bsa.ProxyProperty)
 	if err != nil {
 		log.Warn("failed to fetch ad from BSA ", err)
 		http.Error(w, "Server Internal Error", http.StatusInternalServerError)
@@ -279,10 +379,21 @@ type PubSubMessage struct {
 }
 
 type HealthHandler struct{}
-type AdsHandler struct{}
+type AdsHandler struct {
+	config    *Config
+	stores    Stores
+	providers *adProviders
+	profiles  *profileCache
+	images    *imagePipeline
+	utm       *utmDecorator
+	limiter   *rateLimiter
+	ivt       *ivtDetector
+}
 type App struct {
-	HealthHandler *HealthHandler
-	AdsHandler    *AdsHandler
+	HealthHandler  *HealthHandler
+	AdsHandler     *AdsHandler
+	OpenRTBHandler *OpenRTBHandler
+	PrivacyHandler *PrivacyHandler
 }
 
 func (h *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -296,6 +407,12 @@ func (h *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "a":
 		h.AdsHandler.ServeHTTP(w, r)
 		return
+	case "openrtb":
+		h.OpenRTBHandler.ServeHTTP(w, r)
+		return
+	case "privacy":
+		h.PrivacyHandler.ServeHTTP(w, r)
+		return
 	case "v1":
 		head, r.URL.Path = shiftPath(r.URL.Path)
 		if head == "a" {
@@ -335,24 +452,35 @@ func (h *AdsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
+		r = withConsent(r)
+		r = h.ivt.withVerdict(r)
+
 		if r.URL.Path == "/" {
-			ServeAd(w, r)
+			if h.limiter.allowRequest(w, r, "feed") {
+				ServeAd(w, r, h.config, h.stores, h.providers, h.profiles, h.images, h.utm)
+			}
 			return
 		}
 
 		if r.URL.Path == "/post" {
-			ServePostAd(w, r)
+			if h.limiter.allowRequest(w, r, "post") {
+				ServePostAd(w, r, h.config, h.providers, h.images, h.utm)
+			}
 			return
 		}
 
 		if r.URL.Path == "/toilet" {
-			ServeToilet(w, r)
+			if h.limiter.allowRequest(w, r, "toilet") {
+				ServeToilet(w, r, h.config, h.providers, h.images, h.utm)
+			}
 			return
 		}
 
 		_, tail := shiftPath(r.URL.Path)
 		if tail == "/" {
-			ServeBsa(w, r)
+			if h.limiter.allowRequest(w, r, "bsa") {
+				ServeBsa(w, r, h.config, h.providers)
+			}
 			return
 		}
 	}
@@ -360,9 +488,32 @@ func (h *AdsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Not Found", http.StatusNotFound)
 }
 
-func NewAd(ctx context.Context, log *log.Entry, ad ScheduledCampaignAd) error {
+// Workers handle the messages of the background app
+type Workers struct {
+	stores Stores
+	// publishInvalidations is nil when no invalidation topic is set
+	publishInvalidations func(ctx context.Context, userIds []string) error
+}
+
+// invalidateProfiles tells the serving instances to evict the users from
+// their profile cache. Failures are only logged, the cached profiles expire
+// anyway and retrying the message could count the views twice.
+func (wk *Workers) invalidateProfiles(ctx context.Context, log *log.Entry, userIds ...string) {
+	if wk.publishInvalidations == nil || len(userIds) == 0 {
+		return
+	}
+	if err := wk.publishInvalidations(ctx, userIds); err != nil {
+		log.WithField("users", userIds).Warnf("failed to publish profile invalidations %v", err)
+	}
+}
+
+func (wk *Workers) NewAd(ctx context.Context, log *log.Entry, ad ScheduledCampaignAd) error {
 	log.Infof("[AD %s] adding new campaign ad", ad.Id)
-	if err := addCampaign(ctx, ad); err != nil {
+	if err := validateCampaign(ctx, ad, wk.stores.Campaigns); err != nil {
+		log.WithField("ad", ad).Errorf("[AD %s] invalid campaign ad %v", ad.Id, err)
+		return err
+	}
+	if err := wk.stores.Campaigns.AddCampaign(ctx, ad); err != nil {
 		log.WithField("ad", ad).Errorf("[AD %s] failed to add new campaign ad %v", ad.Id, err)
 		return err
 	}
@@ -371,19 +522,32 @@ func NewAd(ctx context.Context, log *log.Entry, ad ScheduledCampaignAd) error {
 	return nil
 }
 
+// AddOrUpdateUsersTags writes a batch of view tags and invalidates the
+// profiles of its users
+func (wk *Workers) AddOrUpdateUsersTags(ctx context.Context, userTags map[string]map[string]int) error {
+	if err := wk.stores.UserTags.AddOrUpdateUsersTags(ctx, userTags); err != nil {
+		return err
+	}
+	wk.invalidateProfiles(ctx, log.NewEntry(log.StandardLogger()), sortedKeys(userTags)...)
+	return nil
+}
+
 type ViewMessage struct {
 	UserId string
 	Tags   []string
 }
 
-func View(ctx context.Context, log *log.Entry, data ViewMessage) error {
-	if len(data.Tags) > 0 {
-		if err := addOrUpdateUserTags(ctx, data.UserId, data.Tags); err != nil {
-			log.WithField("view", data).Errorf("addOrUpdateUserTags %v", err)
-			return err
+// newViewHandler adds the tags of the views to the batch of the batcher
+func newViewHandler(batcher *tagBatcher) func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+	return func(ctx context.Context, log *log.Entry, data ViewMessage) error {
+		if len(data.Tags) > 0 {
+			if err := batcher.add(data.UserId, data.Tags); err != nil {
+				log.WithField("view", data).Errorf("AddOrUpdateUsersTags %v", err)
+				return err
+			}
 		}
+		return nil
 	}
-	return nil
 }
 
 type user struct {
@@ -399,32 +563,33 @@ type UserUpdatedMessage struct {
 	NewProfile user `json:"newProfile"`
 }
 
-var allowedExperienceLevels = []string{
-	"LESS_THAN_1_YEAR",
-	"MORE_THAN_1_YEAR",
-	"MORE_THAN_2_YEARS",
-	"MORE_THAN_4_YEARS",
-	"NOT_ENGINEER",
-	"MORE_THAN_10_YEARS",
-	"MORE_THAN_6_YEARS",
-}
-
-func CreateUserExperienceLevel(ctx context.Context, log *log.Entry, data UserCreatedMessage) error {
-	if data.User.ExperienceLevel != "" && util.Contains[string](allowedExperienceLevels, data.User.ExperienceLevel) {
-		if err := setOrUpdateExperienceLevel(ctx, data.User.Id, data.User.ExperienceLevel); err != nil {
-			log.WithField("experience", data).Errorf("setOrUpdateExperienceLevel %v", err)
+func (wk *Workers) CreateUserExperienceLevel(ctx context.Context, log *log.Entry, data UserCreatedMessage) error {
+	if isValidExperienceLevel(data.User.ExperienceLevel) {
+		if err := wk.stores.ExperienceLevels.SetExperienceLevel(ctx, data.User.Id, data.User.ExperienceLevel); err != nil {
+			log.WithField("experience", data).Errorf("SetExperienceLevel %v", err)
 			return err
 		}
+		wk.invalidateProfiles(ctx, log, data.User.Id)
 	}
 	return nil
 }
 
-func UpdateUserExperienceLevel(ctx context.Context, log *log.Entry, data UserUpdatedMessage) error {
-	if data.NewProfile.ExperienceLevel != "" && util.Contains[string](allowedExperienceLevels, data.NewProfile.ExperienceLevel) {
-		if err := setOrUpdateExperienceLevel(ctx, data.NewProfile.Id, data.NewProfile.ExperienceLevel); err != nil {
-			log.WithField("experience", data).Errorf("setOrUpdateExperienceLevel %v", err)
+func (wk *Workers) UpdateUserExperienceLevel(ctx context.Context, log *log.Entry, data UserUpdatedMessage) error {
+	// The profile is sent in full, so an empty level was cleared by the user
+	if data.NewProfile.ExperienceLevel == "" {
+		if err := wk.stores.ExperienceLevels.DeleteExperienceLevel(ctx, data.NewProfile.Id); err != nil {
+			log.WithField("experience", data).Errorf("DeleteExperienceLevel %v", err)
 			return err
 		}
+		wk.invalidateProfiles(ctx, log, data.NewProfile.Id)
+		return nil
+	}
+	if isValidExperienceLevel(data.NewProfile.ExperienceLevel) {
+		if err := wk.stores.ExperienceLevels.SetExperienceLevel(ctx, data.NewProfile.Id, data.NewProfile.ExperienceLevel); err != nil {
+			log.WithField("experience", data).Errorf("SetExperienceLevel %v", err)
+			return err
+		}
+		wk.invalidateProfiles(ctx, log, data.NewProfile.Id)
 	}
 	return nil
 }
@@ -433,19 +598,20 @@ type UserDeletedMessage struct {
 	UserId string `json:"id"`
 }
 
-func DeleteUserExperienceLevel(ctx context.Context, log *log.Entry, data UserDeletedMessage) error {
+func (wk *Workers) DeleteUser(ctx context.Context, log *log.Entry, data UserDeletedMessage) error {
 	if data.UserId != "" {
-		if err := deleteUserExperienceLevel(ctx, data.UserId); err != nil {
-			log.WithField("user_deleted", data).Errorf("deleteUserExperienceLevel %v", err)
+		if err := wk.stores.Privacy.EraseUser(ctx, data.UserId); err != nil {
+			log.WithField("user_deleted", data).Errorf("EraseUser %v", err)
 			return err
 		}
+		wk.invalidateProfiles(ctx, log, data.UserId)
 	}
 	return nil
 }
 
-func DeleteOldTags(ctx context.Context, log *log.Entry) error {
-	if err := deleteOldTags(ctx); err != nil {
-		log.Errorf("deleteOldTags %v", err)
+func (wk *Workers) DeleteOldTags(ctx context.Context, log *log.Entry, retention time.Duration) error {
+	if err := wk.stores.UserTags.DeleteOldTags(ctx, retention); err != nil {
+		log.Errorf("DeleteOldTags %v", err)
 		return err
 	}
 	return nil
@@ -460,229 +626,226 @@ func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Not Found", http.StatusNotFound)
 }
 
-func createApp() *App {
+func createApp(cfg *Config, stores Stores) *App {
+	configureHystrix(cfg.Hystrix)
+	images := newImagePipeline(cfg.Images)
 	return &App{
 		HealthHandler: new(HealthHandler),
-		AdsHandler:    new(AdsHandler),
-	}
-}
-
-func subscribeToNewAd() {
-	const sub = "monetization-new-ad"
-	log.Info("receiving messages from ", sub)
-	ctx := context.Background()
-	err := pubsubClient.Subscription(sub).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		childLog := log.WithField("messageId", msg.ID)
-		var data ScheduledCampaignAd
-		if err := json.Unmarshal(msg.Data, &data); err != nil {
-			childLog.Errorf("failed to decode message %v", err)
-			msg.Ack()
-			return
-		}
-
-		if err := NewAd(ctx, childLog, data); err != nil {
-			msg.Nack()
-		} else {
-			msg.Ack()
-		}
+		AdsHandler: &AdsHandler{
+			config:    cfg,
+			stores:    stores,
+			providers: newAdProviders(cfg.Providers),
+			profiles:  newProfileCache(cfg.ProfileCache),
+			images:    images,
+			utm:       newUtmDecorator(cfg.Utm),
+			limiter:   newRateLimiter(cfg.RateLimits.Placements, cfg.RateLimits.IdleTimeout, cfg.RateLimits.TrustedProxies),
+			ivt:       newIvtDetector(cfg.Ivt, cfg.RateLimits.TrustedProxies),
+		},
+		OpenRTBHandler: &OpenRTBHandler{
+			campaigns: stores.Campaigns,
+			images:    images,
+			billing:   &inventoryBilling{url: cfg.Inventory.BillingUrl, buyers: cfg.Inventory.Buyers},
+		},
+		PrivacyHandler: &PrivacyHandler{token: cfg.Privacy.ApiToken, store: stores.Privacy},
+	}
+}
+
+func createBackgroundApp(ctx context.Context, cfg *Config, stores Stores, client *pubsub.Client) error {
+	configureHystrix(cfg.Hystrix)
+	options := cfg.Consumer
+	workers := &Workers{stores: stores}
+	if cfg.ProfileCache.InvalidationTopic != "" {
+		topic := client.Topic(cfg.ProfileCache.InvalidationTopic)
+		defer topic.Stop()
+		workers.publishInvalidations = newProfileInvalidationPublisher(topic)
+	}
+
+	// Delete old tags is triggered by a scheduler and has no payload
+	deleteOldTags := newConsumer(client, "monetization-delete-old-tags", options, func(ctx context.Context, log *log.Entry, _ struct{}) error {
+		return workers.DeleteOldTags(ctx, log, cfg.UserTags.Retention)
 	})
+	deleteOldTags.decode = nil
 
-	if err != nil {
-		log.Fatal("failed to receive messages from pubsub ", err)
-	}
-}
+	batcher := newTagBatcher(cfg.UserTags.ViewBatchSize, cfg.UserTags.ViewBatchWindow, workers.AddOrUpdateUsersTags)
+	// Views are written in batches, so enough messages must be outstanding
+	// to fill a batch
+	views := newConsumer(client, "monetization-views", options, newViewHandler(batcher))
+	views.options.Concurrency = cfg.UserTags.ViewBatchSize
 
-func subscribeToView() {
-	const sub = "monetization-views"
-	log.Info("receiving messages from ", sub)
-	ctx := context.Background()
-	err := pubsubClient.Subscription(sub).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		childLog := log.WithField("messageId", msg.ID)
-		var data ViewMessage
-		if err := json.Unmarshal(msg.Data, &data); err != nil {
-			childLog.Errorf("failed to decode message %v", err)
-			msg.Ack()
-			return
-		}
+	// Campaigns are validated against the ones added before them, so they're
+	// added one at a time. Rejected campaigns go to the campaign team.
+	newAd := newConsumer(client, "monetization-new-ad", options, workers.NewAd)
+	newAd.options.Concurrency = 1
+	if cfg.Campaigns.DeadLetterTopic != "" {
+		newAd.options.DeadLetterTopic = cfg.Campaigns.DeadLetterTopic
+	}
 
-		if err := View(ctx, childLog, data); err != nil {
-			msg.Nack()
-		} else {
-			msg.Ack()
-		}
-	})
+	consumers := []interface {
+		run(ctx context.Context) error
+	}{
+		newAd,
+		views,
+		newConsumer(client, "monetization-user-created", options, workers.CreateUserExperienceLevel),
+		newConsumer(client, "monetization-user-updated", options, workers.UpdateUserExperienceLevel),
+		newConsumer(client, "monetization-user-deleted", options, workers.DeleteUser),
+		deleteOldTags,
+	}
 
-	if err != nil {
-		log.Fatal("failed to receive messages from pubsub ", err)
+	g, ctx := errgroup.WithContext(ctx)
+	for _, c := range consumers {
+		g.Go(func() error { return c.run(ctx) })
 	}
+	return g.Wait()
 }
 
-func subscribeToUserCreated() {
-	const sub = "monetization-user-created"
-	log.Info("receiving messages from ", sub)
-	ctx := context.Background()
-	err := pubsubClient.Subscription(sub).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		childLog := log.WithField("messageId", msg.ID)
-		var data UserCreatedMessage
-		if err := json.Unmarshal(msg.Data, &data); err != nil {
-			childLog.Errorf("failed to decode message %v", err)
-			msg.Ack()
-			return
-		}
-
-		if err := CreateUserExperienceLevel(ctx, childLog, data); err != nil {
-			msg.Nack()
-		} else {
-			msg.Ack()
-		}
-	})
+// runServer serves the app until the context is cancelled and then drains
+// the open connections
+func runServer(ctx context.Context, addr string, handler http.Handler, shutdownTimeout time.Duration) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	errs := make(chan error, 1)
+	go func() {
+		log.Info("server is listening to ", addr)
+		errs <- server.ListenAndServe()
+	}()
 
-	if err != nil {
-		log.Fatal("failed to receive messages from pubsub ", err)
+	select {
+	case err := <-errs:
+		return fmt.Errorf("failed to start listening %w", err)
+	case <-ctx.Done():
 	}
+
+	log.Info("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
 
-func subscribeToUserUpdated() {
-	const sub = "monetization-user-updated"
-	log.Info("receiving messages from ", sub)
-	ctx := context.Background()
-	err := pubsubClient.Subscription(sub).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		childLog := log.WithField("messageId", msg.ID)
-		var data UserUpdatedMessage
-		if err := json.Unmarshal(msg.Data, &data); err != nil {
-			childLog.Errorf("failed to decode message %v", err)
-			msg.Ack()
-			return
-		}
+func init() {
+	registerMetricViews()
+	log.SetOutput(os.Stdout)
+	httpClient = &http.Client{}
+}
 
-		if err := UpdateUserExperienceLevel(ctx, childLog, data); err != nil {
-			msg.Nack()
-		} else {
-			msg.Ack()
-		}
-	})
+// configureObservability sets up the logger and exports the traces and
+// metrics to Stackdriver in production
+func configureObservability(cfg *Config) error {
+	if cfg.CredentialsFile != "" {
+		gcpOpts = append(gcpOpts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
 
-	if err != nil {
-		log.Fatal("failed to receive messages from pubsub ", err)
+	if cfg.Env != "PROD" {
+		return nil
 	}
-}
 
-func subscribeToUserDeleted() {
-	const sub = "monetization-user-deleted"
-	log.Info("receiving messages from ", sub)
-	ctx := context.Background()
-	err := pubsubClient.Subscription(sub).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		childLog := log.WithField("messageId", msg.ID)
-		var data UserDeletedMessage
-		if err := json.Unmarshal(msg.Data, &data); err != nil {
-			childLog.Errorf("failed to decode message %v", err)
-			msg.Ack()
-			return
-		}
+	log.SetFormatter(&log.JSONFormatter{})
 
-		if err := DeleteUserExperienceLevel(ctx, childLog, data); err != nil {
-			msg.Nack()
-		} else {
-			msg.Ack()
-		}
+	var err error
+	exporter, err = stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:          cfg.GcloudProject,
+		TraceClientOptions: gcpOpts,
 	})
-
 	if err != nil {
-		log.Fatal("failed to receive messages from pubsub ", err)
+		return err
 	}
-}
-
-func subscribeToDeleteOldTags() {
-	const sub = "monetization-delete-old-tags"
-	log.Info("receiving messages from ", sub)
-	ctx := context.Background()
-	err := pubsubClient.Subscription(sub).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		childLog := log.WithField("messageId", msg.ID)
-		if err := DeleteOldTags(ctx, childLog); err != nil {
-			msg.Nack()
-		} else {
-			msg.Ack()
-		}
-	})
+	trace.RegisterExporter(exporter)
+	if err := exporter.StartMetricsExporter(); err != nil {
+		return err
+	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(cfg.TraceSampling)})
 
-	if err != nil {
-		log.Fatal("failed to receive messages from pubsub ", err)
+	httpClient = &http.Client{
+		Transport: &ochttp.Transport{
+			// Use Google Cloud propagation format.
+			Propagation: &propagation.HTTPFormat{},
+		},
 	}
+	return nil
 }
 
-func createBackgroundApp() {
-	go subscribeToNewAd()
-	go subscribeToView()
-	go subscribeToUserCreated()
-	go subscribeToUserUpdated()
-	go subscribeToUserDeleted()
-	subscribeToDeleteOldTags()
+// newPubsubClient connects to Pub/Sub or to the local emulator when
+// PUBSUB_EMULATOR_HOST is set
+func newPubsubClient(ctx context.Context, cfg *Config) (*pubsub.Client, error) {
+	return pubsub.NewClient(ctx, cfg.GcloudProject, gcpOpts...)
 }
 
-func init() {
-	hystrix.ConfigureCommand(hystrixDb, hystrix.CommandConfig{Timeout: 300, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100})
-	hystrix.ConfigureCommand(hystrixBsa, hystrix.CommandConfig{Timeout: 700, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100})
-	hystrix.ConfigureCommand(hystrixEa, hystrix.CommandConfig{Timeout: 700, MaxConcurrentRequests: 1000, SleepWindow: 1000, RequestVolumeThreshold: 100})
-
-	if file, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
-		gcpOpts = append(gcpOpts, option.WithCredentialsFile(file))
+func main() {
+	cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		log.Fatal("invalid config\n", err)
 	}
 
-	projectID := os.Getenv("GCLOUD_PROJECT")
-	ctx := context.Background()
-
-	log.SetOutput(os.Stdout)
-	if getEnv("ENV", "DEV") == "PROD" {
-		log.SetFormatter(&log.JSONFormatter{})
-
-		exporter, err := stackdriver.NewExporter(stackdriver.Options{
-			ProjectID:          projectID,
-			TraceClientOptions: gcpOpts,
-		})
-		if err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Stdout, cfg.Database, os.Args[2:]); err != nil {
 			log.Fatal(err)
 		}
-		trace.RegisterExporter(exporter)
-		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(0.25)})
-
-		httpClient = &http.Client{
-			Transport: &ochttp.Transport{
-				// Use Google Cloud propagation format.
-				Propagation: &propagation.HTTPFormat{},
-			},
-		}
-	} else {
-		httpClient = &http.Client{}
+		return
 	}
 
-	var err error
-	pubsubClient, err = pubsub.NewClient(ctx, projectID, gcpOpts...)
-	if err != nil {
+	if err := configureObservability(cfg); err != nil {
 		log.Fatal(err)
 	}
-}
 
-func main() {
-	if len(os.Args) > 1 && os.Args[1] == "migrate" {
-		migrateDatabase()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	openGeolocationDatabase()
+	primaryDb, replicaDb := initializeDatabase(cfg.Database)
+	store, err := newMySQLStore(primaryDb, replicaDb, cfg.Database.Replica, cfg.UserTags.HalfLife)
+	if err != nil {
+		log.Fatal("failed to prepare queries ", err)
+	}
+	stores := newStores(store)
+
+	var pubsubClient *pubsub.Client
+	if len(os.Args) > 1 && os.Args[1] == "background" {
+		log.Info("background processing is on")
+		pubsubClient, err = newPubsubClient(ctx, cfg)
+		if err != nil {
+			log.Fatal("failed to create pubsub client ", err)
+		}
+		err = createBackgroundApp(ctx, cfg, stores, pubsubClient)
 	} else {
-		openGeolocationDatabase()
-		defer closeGeolocationDatabase()
-
-		initializeDatabase()
-		defer tearDatabase()
-
-		if len(os.Args) > 1 && os.Args[1] == "background" {
-			log.Info("background processing is on")
-			createBackgroundApp()
-		} else {
-			app := createApp()
-			addr := fmt.Sprintf(":%s", getEnv("PORT", "9090"))
-			log.Info("server is listening to ", addr)
-			err := http.ListenAndServe(addr, &ochttp.Handler{Handler: app, Propagation: &propagation.HTTPFormat{}}) // set listen addr
+		app := createApp(cfg, stores)
+		addr := fmt.Sprintf(":%d", cfg.Port)
+		g, ctx := errgroup.WithContext(ctx)
+		if cfg.ProfileCache.Size > 0 && cfg.ProfileCache.InvalidationTopic != "" {
+			pubsubClient, err = newPubsubClient(ctx, cfg)
 			if err != nil {
-				log.Fatal("failed to start listening ", err)
+				log.Error("failed to create pubsub client, cached profiles only expire after their ttl ", err)
+			} else {
+				g.Go(func() error {
+					receiveProfileInvalidations(ctx, pubsubClient, cfg.ProfileCache.InvalidationTopic, cfg.Consumer, app.AdsHandler.profiles)
+					return nil
+				})
 			}
 		}
+		g.Go(func() error {
+			return runServer(ctx, addr, &ochttp.Handler{Handler: app, Propagation: &propagation.HTTPFormat{}}, cfg.ShutdownTimeout)
+		})
+		err = g.Wait()
+	}
+	if err != nil {
+		log.Error(err)
+	}
+
+	log.Info("closing resources")
+	if pubsubClient != nil {
+		if err := pubsubClient.Close(); err != nil {
+			log.Warn("failed to close pubsub client ", err)
+		}
+	}
+	store.Close()
+	tearDatabase(primaryDb, replicaDb)
+	closeGeolocationDatabase()
+	if exporter != nil {
+		exporter.StopMetricsExporter()
+		exporter.Flush()
+	}
+
+	if err != nil {
+		os.Exit(1)
 	}
 }
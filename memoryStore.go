@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errDuplicateCampaign = errors.New("campaign already exists")
+
+type memoryUserTag struct {
+	readCount int
+	score     float64
+	lastRead  time.Time
+}
+
+type memoryExperienceLevel struct {
+	level     string
+	updatedAt time.Time
+}
+
+// memoryStore keeps the campaigns and the targeting data of the users in
+// memory with the same semantics as mysqlStore, it implements all the stores
+type memoryStore struct {
+	mutex            sync.RWMutex
+	campaigns        map[string]ScheduledCampaignAd
+	userTags         map[string]map[string]*memoryUserTag
+	experienceLevels map[string]memoryExperienceLevel
+	tagDecay         float64
+	now              func() time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		campaigns:        make(map[string]ScheduledCampaignAd),
+		userTags:         make(map[string]map[string]*memoryUserTag),
+		experienceLevels: make(map[string]memoryExperienceLevel),
+		tagDecay:         userTagDecay(defaultConfig().UserTags.HalfLife),
+		now:              time.Now,
+	}
+}
+
+func (s *memoryStore) AddCampaign(ctx context.Context, camp ScheduledCampaignAd) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.campaigns[camp.Id]; exists {
+		return errDuplicateCampaign
+	}
+	s.campaigns[camp.Id] = camp
+	return nil
+}
+
+// isTagRelevant tells whether the user read any of the tags, must be called
+// with the mutex held
+func (s *memoryStore) isTagRelevant(userId string, tags []string) bool {
+	for _, tag := range tags {
+		if _, ok := s.userTags[userId][tag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isExpRelevant tells whether the experience level of the user is one of the
+// levels or within the range of the campaign, must be called with the mutex
+// held
+func (s *memoryStore) isExpRelevant(userId string, camp ScheduledCampaignAd) bool {
+	userLevel, ok := s.experienceLevels[userId]
+	if !ok {
+		return false
+	}
+	level := userLevel.level
+	for _, l := range camp.ExperienceLevels {
+		if l == level {
+			return true
+		}
+	}
+	if camp.MinExperienceLevel == "" && camp.MaxExperienceLevel == "" {
+		return false
+	}
+	rank := experienceLevelRank(level)
+	return rank > 0 &&
+		rank >= experienceLevelRank(camp.MinExperienceLevel) &&
+		(camp.MaxExperienceLevel == "" || rank <= experienceLevelRank(camp.MaxExperienceLevel))
+}
+
+func (s *memoryStore) FetchCampaigns(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ids := sortedKeys(s.campaigns)
+	var res []CampaignAd
+	for _, id := range ids {
+		scheduled := s.campaigns[id]
+		if scheduled.Start.After(timestamp) || !scheduled.End.After(timestamp) {
+			continue
+		}
+
+		camp := scheduled.CampaignAd
+		camp.utm = scheduled.Utm
+		camp.IsTagTargeted = len(scheduled.Tags) > 0
+		camp.IsExpTargeted = len(scheduled.ExperienceLevels) > 0 || scheduled.MinExperienceLevel != "" || scheduled.MaxExperienceLevel != ""
+		if camp.IsTagTargeted && !s.isTagRelevant(userId, scheduled.Tags) {
+			continue
+		}
+		if camp.IsExpTargeted && !s.isExpRelevant(userId, scheduled) {
+			continue
+		}
+
+		camp.ProviderId = campaignProviderId(camp)
+		res = append(res, camp)
+	}
+	return res, nil
+}
+
+func (s *memoryStore) FetchOverlappingCampaigns(ctx context.Context, start time.Time, end time.Time) ([]ScheduledCampaignAd, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var res []ScheduledCampaignAd
+	for _, id := range sortedKeys(s.campaigns) {
+		camp := s.campaigns[id]
+		if camp.Start.Before(end) && camp.End.After(start) {
+			res = append(res, camp)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryStore) AddOrUpdateUsersTags(ctx context.Context, userTags map[string]map[string]int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	for userId, reads := range userTags {
+		tags, ok := s.userTags[userId]
+		if !ok {
+			tags = make(map[string]*memoryUserTag)
+			s.userTags[userId] = tags
+		}
+		for tag, count := range reads {
+			if existing, ok := tags[tag]; ok {
+				existing.score = existing.score*math.Exp(-s.tagDecay*now.Sub(existing.lastRead).Seconds()) + float64(count)
+				existing.readCount += count
+				existing.lastRead = now
+			} else {
+				tags[tag] = &memoryUserTag{readCount: count, score: float64(count), lastRead: now}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetUserTags(ctx context.Context, userId string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// Rank the tags by their interest score decayed to now
+	now := s.now()
+	scores := make(map[string]float64, len(s.userTags[userId]))
+	var res []string
+	for tag, userTag := range s.userTags[userId] {
+		scores[tag] = userTag.score * math.Exp(-s.tagDecay*now.Sub(userTag.lastRead).Seconds())
+		res = append(res, tag)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if scores[res[i]] != scores[res[j]] {
+			return scores[res[i]] > scores[res[j]]
+		}
+		return res[i] < res[j]
+	})
+	if len(res) > 50 {
+		res = res[:50]
+	}
+	return res, nil
+}
+
+func (s *memoryStore) DeleteOldTags(ctx context.Context, retention time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deadline := s.now().Add(-retention)
+	for userId, tags := range s.userTags {
+		for tag, userTag := range tags {
+			if userTag.lastRead.Before(deadline) {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.userTags, userId)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SetExperienceLevel(ctx context.Context, userId string, experienceLevel string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.experienceLevels[userId] = memoryExperienceLevel{level: experienceLevel, updatedAt: s.now()}
+	return nil
+}
+
+func (s *memoryStore) DeleteExperienceLevel(ctx context.Context, userId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.experienceLevels, userId)
+	return nil
+}
+
+func (s *memoryStore) GetExperienceLevel(ctx context.Context, userId string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if userLevel, ok := s.experienceLevels[userId]; ok {
+		return userLevel.level, nil
+	}
+	return "UNKNOWN", nil
+}
+
+func (s *memoryStore) EraseUser(ctx context.Context, userId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.userTags, userId)
+	delete(s.experienceLevels, userId)
+	return nil
+}
+
+// ExportUserData formats the dates like the database does, memoryStore
+// doesn't keep segments
+func (s *memoryStore) ExportUserData(ctx context.Context, userId string) (*UserDataExport, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	res := &UserDataExport{UserId: userId, Tags: []UserTagExport{}}
+	for _, tag := range sortedKeys(s.userTags[userId]) {
+		userTag := s.userTags[userId][tag]
+		res.Tags = append(res.Tags, UserTagExport{
+			Tag:       tag,
+			LastRead:  userTag.lastRead.Format(time.DateTime),
+			ReadCount: userTag.readCount,
+			Score:     userTag.score,
+		})
+	}
+	if userLevel, ok := s.experienceLevels[userId]; ok {
+		res.ExperienceLevel = &UserExperienceLevelExport{
+			ExperienceLevel: userLevel.level,
+			UpdatedAt:       userLevel.updatedAt.Format(time.DateTime),
+		}
+	}
+	return res, nil
+}
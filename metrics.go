@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var keyProvider = tag.MustNewKey("provider")
+var keySubscription = tag.MustNewKey("subscription")
+var keyOutcome = tag.MustNewKey("outcome")
+var keyReason = tag.MustNewKey("reason")
+var keyPlacement = tag.MustNewKey("placement")
+var keyBuyer = tag.MustNewKey("buyer")
+
+var (
+	providerCacheHits   = stats.Int64("monetization/provider_cache_hits", "Provider calls served from the cache", stats.UnitDimensionless)
+	providerCacheMisses = stats.Int64("monetization/provider_cache_misses", "Provider calls that missed the cache", stats.UnitDimensionless)
+
+	consumerReceived       = stats.Int64("monetization/consumer_received", "Messages received from a subscription", stats.UnitDimensionless)
+	consumerDecodeFailures = stats.Int64("monetization/consumer_decode_failures", "Messages that couldn't be decoded", stats.UnitDimensionless)
+	consumerLatency        = stats.Float64("monetization/consumer_latency", "Time to process a message", stats.UnitMilliseconds)
+
+	ivtRequests = stats.Int64("monetization/ivt_requests", "Ad requests by invalid traffic verdict", stats.UnitDimensionless)
+
+	rateLimitedRequests = stats.Int64("monetization/rate_limited_requests", "Ad requests rejected by the rate limiter", stats.UnitDimensionless)
+
+	inventoryRevenue = stats.Float64("monetization/inventory_revenue", "Clearing price of the impressions won by the buyers, in USD CPM", stats.UnitDimensionless)
+)
+
+var metricViews = []*view.View{
+	{Name: "monetization/provider_cache_hits", Measure: providerCacheHits, Aggregation: view.Count(), TagKeys: []tag.Key{keyProvider}},
+	{Name: "monetization/provider_cache_misses", Measure: providerCacheMisses, Aggregation: view.Count(), TagKeys: []tag.Key{keyProvider}},
+	{Name: "monetization/consumer_received", Measure: consumerReceived, Aggregation: view.Count(), TagKeys: []tag.Key{keySubscription}},
+	{Name: "monetization/consumer_decode_failures", Measure: consumerDecodeFailures, Aggregation: view.Count(), TagKeys: []tag.Key{keySubscription}},
+	{Name: "monetization/consumer_outcomes", Measure: consumerLatency, Aggregation: view.Count(), TagKeys: []tag.Key{keySubscription, keyOutcome}},
+	{Name: "monetization/consumer_latency", Measure: consumerLatency, Aggregation: view.Distribution(5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000), TagKeys: []tag.Key{keySubscription, keyOutcome}},
+	{Name: "monetization/ivt_requests", Measure: ivtRequests, Aggregation: view.Count(), TagKeys: []tag.Key{keyReason}},
+	{Name: "monetization/rate_limited_requests", Measure: rateLimitedRequests, Aggregation: view.Count(), TagKeys: []tag.Key{keyPlacement}},
+	{Name: "monetization/inventory_impressions", Measure: inventoryRevenue, Aggregation: view.Count(), TagKeys: []tag.Key{keyBuyer}},
+	{Name: "monetization/inventory_revenue", Measure: inventoryRevenue, Aggregation: view.Sum(), TagKeys: []tag.Key{keyBuyer}},
+}
+
+func registerMetricViews() {
+	if err := view.Register(metricViews...); err != nil {
+		log.Fatal("failed to register metric views ", err)
+	}
+}
+
+func recordProviderMetric(ctx context.Context, provider string, measure *stats.Int64Measure) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(keyProvider, provider)}, measure.M(1))
+}
+
+func recordPlacementMetric(ctx context.Context, placement string, measure *stats.Int64Measure) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(keyPlacement, placement)}, measure.M(1))
+}
+
+func recordConsumerMetric(ctx context.Context, subscription string, measure *stats.Int64Measure) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(keySubscription, subscription)}, measure.M(1))
+}
+
+func recordConsumerOutcome(ctx context.Context, subscription string, outcome consumerOutcome, latency time.Duration) {
+	_ = stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(keySubscription, subscription), tag.Upsert(keyOutcome, string(outcome))},
+		consumerLatency.M(float64(latency.Microseconds())/1000))
+}
+
+func recordIvtVerdict(ctx context.Context, verdict ivtVerdict) {
+	reason := verdict.Reason
+	if !verdict.Flagged {
+		reason = "valid"
+	}
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(keyReason, reason)}, ivtRequests.M(1))
+}
+
+func recordInventoryImpression(ctx context.Context, buyer string, price float64) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(keyBuyer, buyer)}, inventoryRevenue.M(price))
+}
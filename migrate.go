@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+const migrateUsage = "usage: migrate [up [N]|down N|goto V|status|force V|drop --force]"
+
+type migrateCommand struct {
+	name string
+	arg  int
+}
+
+// parseMigrateCommand parses the arguments that follow migrate, without any
+// arguments the database is migrated to the version the code expects
+func parseMigrateCommand(args []string) (migrateCommand, error) {
+	if len(args) == 0 {
+		return migrateCommand{name: "goto", arg: int(migrationVer)}, nil
+	}
+
+	cmd := migrateCommand{name: args[0]}
+	var needsArg, optionalArg bool
+	switch cmd.name {
+	case "up":
+		optionalArg = true
+	case "down", "goto", "force":
+		needsArg = true
+	case "status":
+	case "drop":
+		// Dropping deletes all the data, so it has to be confirmed
+		if len(args) != 2 || args[1] != "--force" {
+			return cmd, fmt.Errorf("drop deletes every table, run drop --force to confirm\n%s", migrateUsage)
+		}
+		return cmd, nil
+	default:
+		return cmd, fmt.Errorf("unknown migrate command %s\n%s", cmd.name, migrateUsage)
+	}
+
+	switch {
+	case len(args) == 2 && (needsArg || optionalArg):
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || (n == 0 && cmd.name != "force") {
+			return cmd, fmt.Errorf("invalid argument %s for %s\n%s", args[1], cmd.name, migrateUsage)
+		}
+		cmd.arg = n
+	case len(args) == 1 && !needsArg:
+	default:
+		return cmd, fmt.Errorf("wrong number of arguments for %s\n%s", cmd.name, migrateUsage)
+	}
+	return cmd, nil
+}
+
+func printMigrateStatus(out io.Writer, m *migrate.Migrate) error {
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		_, _ = fmt.Fprintf(out, "version: none, dirty: false, expected: %d\n", migrationVer)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "version: %d, dirty: %t, expected: %d\n", version, dirty, migrationVer)
+	return nil
+}
+
+func runMigrateCommand(out io.Writer, cfg DatabaseConfig, args []string) error {
+	cmd, err := parseMigrateCommand(args)
+	if err != nil {
+		return err
+	}
+
+	m, err := newMigrate(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch cmd.name {
+	case "up":
+		if cmd.arg > 0 {
+			err = m.Steps(cmd.arg)
+		} else {
+			err = m.Up()
+		}
+	case "down":
+		err = m.Steps(-cmd.arg)
+	case "goto":
+		err = m.Migrate(uint(cmd.arg))
+	case "force":
+		err = m.Force(cmd.arg)
+	case "drop":
+		// The version table is dropped along with everything else
+		if err := m.Drop(); err != nil {
+			return fmt.Errorf("failed to drop: %w", err)
+		}
+		_, _ = fmt.Fprintln(out, "dropped all tables")
+		return nil
+	}
+	if errors.Is(err, migrate.ErrNoChange) {
+		_, _ = fmt.Fprintln(out, "no change")
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", cmd.name, err)
+	}
+	return printMigrateStatus(out, m)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMigrateCommand(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected migrateCommand
+	}{
+		{args: nil, expected: migrateCommand{name: "goto", arg: int(migrationVer)}},
+		{args: []string{"up"}, expected: migrateCommand{name: "up"}},
+		{args: []string{"up", "2"}, expected: migrateCommand{name: "up", arg: 2}},
+		{args: []string{"down", "1"}, expected: migrateCommand{name: "down", arg: 1}},
+		{args: []string{"goto", "10"}, expected: migrateCommand{name: "goto", arg: 10}},
+		{args: []string{"force", "0"}, expected: migrateCommand{name: "force"}},
+		{args: []string{"status"}, expected: migrateCommand{name: "status"}},
+		{args: []string{"drop", "--force"}, expected: migrateCommand{name: "drop"}},
+	}
+	for _, c := range cases {
+		cmd, err := parseMigrateCommand(c.args)
+		assert.NoError(t, err, c.args)
+		assert.Equal(t, c.expected, cmd, c.args)
+	}
+
+	for _, args := range [][]string{{"down"}, {"down", "0"}, {"goto", "v1"}, {"force", "-1"}, {"status", "1"}, {"up", "1", "2"}, {"reset"}, {"drop"}, {"drop", "force"}, {"drop", "--force", "1"}} {
+		_, err := parseMigrateCommand(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	source, err := iofs.New(migrationsFS, "migrations")
+	require.NoError(t, err)
+	defer source.Close()
+
+	version, err := source.First()
+	require.NoError(t, err)
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		require.NoError(t, err)
+		version = next
+	}
+	assert.Equal(t, migrationVer, version, "migrationVer should be the latest embedded migration")
+}
+
+func TestMigrateCommands(t *testing.T) {
+	defer dropDatabase(testConfig.Database)
+
+	var out bytes.Buffer
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"status"}))
+	assert.Contains(t, out.String(), "version: none, dirty: false")
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, nil))
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"down", "2"}))
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"status"}))
+	assert.Contains(t, out.String(), fmt.Sprintf("version: %d, dirty: false", migrationVer-2))
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"up"}))
+	assert.Contains(t, out.String(), fmt.Sprintf("version: %d, dirty: false", migrationVer))
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"up"}))
+	assert.Contains(t, out.String(), "no change")
+
+	// Migrations aren't idempotent, so goto has to move from a version the
+	// schema is actually at
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"down", "1"}))
+	assert.Contains(t, out.String(), fmt.Sprintf("version: %d, dirty: false", migrationVer-1))
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"goto", fmt.Sprint(migrationVer)}))
+	assert.Contains(t, out.String(), fmt.Sprintf("version: %d, dirty: false", migrationVer))
+
+	// Forcing the version the schema is at only clears the dirty flag
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"force", fmt.Sprint(migrationVer)}))
+	assert.Contains(t, out.String(), fmt.Sprintf("version: %d, dirty: false", migrationVer))
+
+	out.Reset()
+	assert.ErrorContains(t, runMigrateCommand(&out, testConfig.Database, []string{"drop"}), "drop --force")
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"status"}))
+	assert.Contains(t, out.String(), fmt.Sprintf("version: %d, dirty: false", migrationVer), "drop without --force should keep the tables")
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(&out, testConfig.Database, []string{"drop", "--force"}))
+	assert.Contains(t, out.String(), "dropped all tables")
+}
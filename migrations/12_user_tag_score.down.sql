@@ -0,0 +1,3 @@
+ALTER TABLE `user_tags`
+    DROP COLUMN `read_count`,
+    DROP COLUMN `score`;
@@ -0,0 +1,3 @@
+ALTER TABLE `user_tags`
+    ADD COLUMN `read_count` INT UNSIGNED NOT NULL DEFAULT 1,
+    ADD COLUMN `score` DOUBLE NOT NULL DEFAULT 1;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS `ad_experience_range` (
+  `ad_id` varchar(255) NOT NULL REFERENCES ads(id),
+  `min_experience_level` varchar(255) CHARACTER SET utf8mb4 NULL,
+  `max_experience_level` varchar(255) CHARACTER SET utf8mb4 NULL,
+  PRIMARY KEY (`ad_id`)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE `ads`
+    DROP COLUMN `utm_source`,
+    DROP COLUMN `utm_medium`,
+    DROP COLUMN `utm_campaign`,
+    DROP COLUMN `utm_content`;
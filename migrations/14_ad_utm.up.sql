@@ -0,0 +1,5 @@
+ALTER TABLE `ads`
+    ADD COLUMN `utm_source` varchar(255) CHARACTER SET utf8mb4 NULL,
+    ADD COLUMN `utm_medium` varchar(255) CHARACTER SET utf8mb4 NULL,
+    ADD COLUMN `utm_campaign` varchar(255) CHARACTER SET utf8mb4 NULL,
+    ADD COLUMN `utm_content` varchar(255) CHARACTER SET utf8mb4 NULL;
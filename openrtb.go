@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subset of the OpenRTB 2.6 object model that is needed to buy native ads
+
+type OpenRTBBidRequest struct {
+	Id     string         `json:"id"`
+	Imp    []OpenRTBImp   `json:"imp"`
+	Site   *OpenRTBSite   `json:"site,omitempty"`
+	Device *OpenRTBDevice `json:"device,omitempty"`
+	User   *OpenRTBUser   `json:"user,omitempty"`
+	Regs   *OpenRTBRegs   `json:"regs,omitempty"`
+	At     int            `json:"at,omitempty"`
+	TMax   int            `json:"tmax,omitempty"`
+	Cur    []string       `json:"cur,omitempty"`
+}
+
+type OpenRTBImp struct {
+	Id          string         `json:"id"`
+	TagId       string         `json:"tagid,omitempty"`
+	Native      *OpenRTBNative `json:"native,omitempty"`
+	BidFloor    float64        `json:"bidfloor,omitempty"`
+	BidFloorCur string         `json:"bidfloorcur,omitempty"`
+	Secure      int            `json:"secure,omitempty"`
+}
+
+type OpenRTBNative struct {
+	Request string `json:"request"`
+	Ver     string `json:"ver,omitempty"`
+}
+
+type OpenRTBSite struct {
+	Id     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Page   string `json:"page,omitempty"`
+}
+
+type OpenRTBDevice struct {
+	Ua   string      `json:"ua,omitempty"`
+	Ip   string      `json:"ip,omitempty"`
+	Ipv6 string      `json:"ipv6,omitempty"`
+	Geo  *OpenRTBGeo `json:"geo,omitempty"`
+}
+
+type OpenRTBGeo struct {
+	Country string `json:"country,omitempty"`
+	Type    int    `json:"type,omitempty"`
+}
+
+type OpenRTBUser struct {
+	Id       string `json:"id,omitempty"`
+	Keywords string `json:"keywords,omitempty"`
+	// Consent is the TCF v2 consent string of the user
+	Consent string `json:"consent,omitempty"`
+}
+
+type OpenRTBRegs struct {
+	// Gdpr is 1 when the request is subject to the GDPR
+	Gdpr int `json:"gdpr,omitempty"`
+}
+
+type OpenRTBBidResponse struct {
+	Id      string           `json:"id"`
+	SeatBid []OpenRTBSeatBid `json:"seatbid,omitempty"`
+	BidId   string           `json:"bidid,omitempty"`
+	Cur     string           `json:"cur,omitempty"`
+	Nbr     int              `json:"nbr,omitempty"`
+}
+
+type OpenRTBSeatBid struct {
+	Bid  []OpenRTBBid `json:"bid"`
+	Seat string       `json:"seat,omitempty"`
+}
+
+type OpenRTBBid struct {
+	Id      string   `json:"id"`
+	ImpId   string   `json:"impid"`
+	Price   float64  `json:"price"`
+	NUrl    string   `json:"nurl,omitempty"`
+	BUrl    string   `json:"burl,omitempty"`
+	Adm     string   `json:"adm,omitempty"`
+	ADomain []string `json:"adomain,omitempty"`
+	CrId    string   `json:"crid,omitempty"`
+}
+
+// Native 1.2 request and response markup
+
+const (
+	nativeAssetTitle = iota + 1
+	nativeAssetImage
+	nativeAssetDescription
+	nativeAssetSponsored
+)
+
+type NativeRequest struct {
+	Ver           string               `json:"ver"`
+	Assets        []NativeRequestAsset `json:"assets"`
+	EventTrackers []NativeEventTracker `json:"eventtrackers,omitempty"`
+}
+
+type NativeRequestAsset struct {
+	Id       int               `json:"id"`
+	Required int               `json:"required,omitempty"`
+	Title    *NativeTitleAsset `json:"title,omitempty"`
+	Img      *NativeImageAsset `json:"img,omitempty"`
+	Data     *NativeDataAsset  `json:"data,omitempty"`
+}
+
+type NativeTitleAsset struct {
+	Len  int    `json:"len,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+type NativeImageAsset struct {
+	Type int    `json:"type,omitempty"`
+	W    int    `json:"w,omitempty"`
+	H    int    `json:"h,omitempty"`
+	WMin int    `json:"wmin,omitempty"`
+	HMin int    `json:"hmin,omitempty"`
+	Url  string `json:"url,omitempty"`
+}
+
+type NativeDataAsset struct {
+	Type  int    `json:"type,omitempty"`
+	Len   int    `json:"len,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type NativeEventTracker struct {
+	Event   int    `json:"event"`
+	Methods []int  `json:"methods,omitempty"`
+	Method  int    `json:"method,omitempty"`
+	Url     string `json:"url,omitempty"`
+}
+
+type NativeResponse struct {
+	Ver           string                `json:"ver,omitempty"`
+	Assets        []NativeResponseAsset `json:"assets"`
+	Link          NativeLink            `json:"link"`
+	ImpTrackers   []string              `json:"imptrackers,omitempty"`
+	EventTrackers []NativeEventTracker  `json:"eventtrackers,omitempty"`
+}
+
+type NativeResponseAsset struct {
+	Id    int               `json:"id"`
+	Title *NativeTitleAsset `json:"title,omitempty"`
+	Img   *NativeImageAsset `json:"img,omitempty"`
+	Data  *NativeDataAsset  `json:"data,omitempty"`
+}
+
+type NativeLink struct {
+	Url string `json:"url"`
+}
+
+type OpenRTBAd struct {
+	Ad
+	Pixel []string
+}
+
+type openRTBBidder struct {
+	Name     string
+	Endpoint string
+}
+
+type openRTBBid struct {
+	OpenRTBBid
+	Seat    string
+	Bidder  string
+	Cur     string
+	Request *OpenRTBBidRequest
+}
+
+var hystrixOpenRTB = "OpenRTB"
+
+// newOpenRTBBidders lists the bidders sorted by name
+func newOpenRTBBidders(endpoints map[string]string) []openRTBBidder {
+	var bidders []openRTBBidder
+	for _, name := range sortedKeys(endpoints) {
+		bidders = append(bidders, openRTBBidder{Name: name, Endpoint: endpoints[name]})
+	}
+	return bidders
+}
+
+func newNativeRequest() string {
+	req := NativeRequest{
+		Ver: "1.2",
+		Assets: []NativeRequestAsset{
+			{Id: nativeAssetTitle, Required: 1, Title: &NativeTitleAsset{Len: 90}},
+			{Id: nativeAssetImage, Required: 1, Img: &NativeImageAsset{Type: 3, WMin: 300, HMin: 150}},
+			{Id: nativeAssetDescription, Data: &NativeDataAsset{Type: 2, Len: 140}},
+			{Id: nativeAssetSponsored, Data: &NativeDataAsset{Type: 1}},
+		},
+		EventTrackers: []NativeEventTracker{{Event: 1, Methods: []int{1}}},
+	}
+	js, _ := json.Marshal(req)
+	return string(js)
+}
+
+func buildOpenRTBRequest(p *adProviders, r *http.Request, id string, tags []string) OpenRTBBidRequest {
+	ip := p.ipAddress(r, hystrixOpenRTB)
+	device := &OpenRTBDevice{Ua: r.UserAgent()}
+	if strings.Contains(ip, ":") {
+		device.Ipv6 = ip
+	} else {
+		device.Ip = ip
+	}
+	if country := getCountryCodeByIP(getIpAddress(r)); country != "" {
+		device.Geo = &OpenRTBGeo{Country: country, Type: 2}
+	}
+
+	var user *OpenRTBUser
+	if len(tags) > 0 {
+		user = &OpenRTBUser{Keywords: strings.Join(tags, ",")}
+	}
+
+	return OpenRTBBidRequest{
+		Id: id,
+		Imp: []OpenRTBImp{
+			{
+				Id:          "1",
+				TagId:       "feed",
+				Native:      &OpenRTBNative{Request: newNativeRequest(), Ver: "1.2"},
+				BidFloor:    p.openRTBFloor,
+				BidFloorCur: "USD",
+				Secure:      1,
+			},
+		},
+		Site:   &OpenRTBSite{Name: "daily.dev", Domain: "daily.dev"},
+		Device: device,
+		User:   user,
+		At:     1,
+		TMax:   int(p.openRTBTimeout.Milliseconds()),
+		Cur:    []string{"USD"},
+	}
+}
+
+func sendOpenRTBRequest(ctx context.Context, bidder openRTBBidder, bidReq *OpenRTBBidRequest) (OpenRTBBidResponse, error) {
+	var res OpenRTBBidResponse
+	body, err := json.Marshal(bidReq)
+	if err != nil {
+		return res, err
+	}
+	req, _ := http.NewRequest("POST", bidder.Endpoint, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-openrtb-version", "2.6")
+	req = req.WithContext(ctx)
+	err = getJsonHystrix(providerBreaker(hystrixOpenRTB, bidder.Name), req, &res, false)
+	return res, err
+}
+
+// collectOpenRTBBids calls all the bidders in parallel and returns every bid
+// that was received before the deadline
+func collectOpenRTBBids(ctx context.Context, p *adProviders, bidReq *OpenRTBBidRequest) []openRTBBid {
+	ctx, cancel := context.WithTimeout(ctx, p.openRTBTimeout)
+	defer cancel()
+
+	results := make(chan []openRTBBid, len(p.openRTBBidders))
+	for _, bidder := range p.openRTBBidders {
+		go func(bidder openRTBBidder) {
+			res, err := sendOpenRTBRequest(ctx, bidder, bidReq)
+			if err != nil {
+				log.Warnf("failed to fetch bids from %s %v", bidder.Name, err)
+				results <- nil
+				return
+			}
+			var bids []openRTBBid
+			for _, seat := range res.SeatBid {
+				for _, bid := range seat.Bid {
+					bids = append(bids, openRTBBid{OpenRTBBid: bid, Seat: seat.Seat, Bidder: bidder.Name, Cur: res.Cur, Request: bidReq})
+				}
+			}
+			results <- bids
+		}(bidder)
+	}
+
+	var bids []openRTBBid
+	for range p.openRTBBidders {
+		bids = append(bids, <-results...)
+	}
+	return bids
+}
+
+// runOpenRTBAuction runs a first-price auction and returns the winning bid or
+// nil when no bid clears the floor
+func runOpenRTBAuction(imp OpenRTBImp, bids []openRTBBid) *openRTBBid {
+	var winner *openRTBBid
+	for i := range bids {
+		bid := &bids[i]
+		if bid.ImpId != imp.Id || bid.Adm == "" {
+			continue
+		}
+		if bid.Cur != "" && bid.Cur != "USD" {
+			continue
+		}
+		if bid.Price <= 0 || bid.Price < imp.BidFloor {
+			continue
+		}
+		if winner == nil || bid.Price > winner.Price {
+			winner = bid
+		}
+	}
+	return winner
+}
+
+func replaceAuctionMacros(value string, bid *openRTBBid) string {
+	return strings.NewReplacer(
+		"${AUCTION_ID}", bid.Request.Id,
+		"${AUCTION_BID_ID}", bid.Id,
+		"${AUCTION_IMP_ID}", bid.ImpId,
+		"${AUCTION_SEAT_ID}", bid.Seat,
+		"${AUCTION_PRICE}", strconv.FormatFloat(bid.Price, 'f', -1, 64),
+		"${AUCTION_CURRENCY}", "USD",
+	).Replace(value)
+}
+
+// parseNativeMarkup supports both the native 1.1 wrapped markup and the 1.2 one
+func parseNativeMarkup(adm string) (*NativeResponse, error) {
+	var wrapped struct {
+		Native *NativeResponse `json:"native"`
+	}
+	if err := json.Unmarshal([]byte(adm), &wrapped); err != nil {
+		return nil, err
+	}
+	if wrapped.Native != nil {
+		return wrapped.Native, nil
+	}
+
+	var native NativeResponse
+	if err := json.Unmarshal([]byte(adm), &native); err != nil {
+		return nil, err
+	}
+	return &native, nil
+}
+
+func openRTBBidToAd(bid *openRTBBid) (*OpenRTBAd, error) {
+	native, err := parseNativeMarkup(replaceAuctionMacros(bid.Adm, bid))
+	if err != nil {
+		return nil, err
+	}
+
+	ad := OpenRTBAd{Pixel: []string{}}
+	for _, asset := range native.Assets {
+		switch {
+		case asset.Title != nil:
+			ad.Description = asset.Title.Text
+		case asset.Img != nil:
+			ad.Image = asset.Img.Url
+		case asset.Data != nil && asset.Id == nativeAssetSponsored:
+			ad.Company = asset.Data.Value
+		}
+	}
+	if ad.Description == "" || native.Link.Url == "" {
+		return nil, fmt.Errorf("bid %s is missing required assets", bid.Id)
+	}
+
+	ad.Link = native.Link.Url
+	ad.Source = bid.Bidder
+	if ad.Company == "" {
+		if len(bid.ADomain) > 0 {
+			ad.Company = bid.ADomain[0]
+		} else {
+			ad.Company = ad.Source
+		}
+	}
+	ad.ProviderId = "openrtb"
+	ad.Pixel = append(ad.Pixel, native.ImpTrackers...)
+	for _, tracker := range native.EventTrackers {
+		if tracker.Event == 1 && tracker.Method == 1 && tracker.Url != "" {
+			ad.Pixel = append(ad.Pixel, tracker.Url)
+		}
+	}
+	return &ad, nil
+}
+
+// notifyOpenRTBWin fires the win and billing notices of the winning bid
+var notifyOpenRTBWin = func(bid *openRTBBid) {
+	for _, notice := range []string{bid.NUrl, bid.BUrl} {
+		if notice == "" {
+			continue
+		}
+		go func(notice string) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, "GET", replaceAuctionMacros(notice, bid), nil)
+			if err != nil {
+				log.Warn("failed to create openrtb notice ", err)
+				return
+			}
+			res, err := httpClient.Do(req)
+			if err != nil {
+				log.Warn("failed to send openrtb notice ", err)
+				return
+			}
+			res.Body.Close()
+		}(notice)
+	}
+}
+
+var fetchOpenRTB = func(p *adProviders, r *http.Request, tags []string) (*OpenRTBAd, error) {
+	if len(p.openRTBBidders) == 0 {
+		return nil, nil
+	}
+
+	bidReq := buildOpenRTBRequest(p, r, strconv.FormatInt(time.Now().UnixNano(), 36), tags)
+	bids := collectOpenRTBBids(r.Context(), p, &bidReq)
+	winner := runOpenRTBAuction(bidReq.Imp[0], bids)
+	if winner == nil {
+		return nil, nil
+	}
+
+	ad, err := openRTBBidToAd(winner)
+	if err != nil {
+		return nil, err
+	}
+	notifyOpenRTBWin(winner)
+	return ad, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dailydotdev/platform-go-common/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// placementFormat describes how a campaign is rendered in one of our placements
+type placementFormat struct {
+	TitleLen    int
+	ImageWidth  int
+	ImageHeight int
+}
+
+var openRTBPlacements = map[string]placementFormat{
+	"feed": {TitleLen: 90, ImageWidth: 1200, ImageHeight: 600},
+	"post": {TitleLen: 140, ImageWidth: 1200, ImageHeight: 600},
+}
+
+// Bid requests are a few kilobytes, anything larger isn't read
+const maxBidRequestSize = 64 << 10
+
+type OpenRTBHandler struct {
+	campaigns CampaignStore
+	images    *imagePipeline
+	billing   *inventoryBilling
+}
+
+// inventoryBilling signs the billing notices of the bids with the token of
+// the buyer, so only the buyer that won the impression can report it
+type inventoryBilling struct {
+	url    string
+	buyers map[string]string
+}
+
+func (b *inventoryBilling) signature(buyer string, bidId string, campaignId string) string {
+	mac := hmac.New(sha256.New, []byte(b.buyers[buyer]))
+	mac.Write([]byte(bidId + "\n" + campaignId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// noticeUrl is the burl of the bid, the buyer replaces the price macro with
+// the clearing price
+func (b *inventoryBilling) noticeUrl(buyer string, bidId string, campaignId string) string {
+	query := url.Values{
+		"buyer": {buyer},
+		"bid":   {bidId},
+		"crid":  {campaignId},
+		"sig":   {b.signature(buyer, bidId, campaignId)},
+	}
+	sep := "?"
+	if strings.Contains(b.url, "?") {
+		sep = "&"
+	}
+	return b.url + sep + query.Encode() + "&price=${AUCTION_PRICE}"
+}
+
+// authenticate returns the buyer of the bearer token of the request
+func (b *inventoryBilling) authenticate(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", false
+	}
+	for _, buyer := range sortedKeys(b.buyers) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(b.buyers[buyer])) == 1 {
+			return buyer, true
+		}
+	}
+	return "", false
+}
+
+// nativeRequestAssetIds maps the assets of the buyer's native request to
+// their ids so the markup we return references the same assets
+func nativeRequestAssetIds(imp OpenRTBImp) map[string]int {
+	ids := map[string]int{
+		"title":     nativeAssetTitle,
+		"image":     nativeAssetImage,
+		"sponsored": nativeAssetSponsored,
+	}
+	if imp.Native == nil || imp.Native.Request == "" {
+		return ids
+	}
+
+	// Native 1.1 requests wrap the assets in a native object
+	var native struct {
+		NativeRequest
+		Native *NativeRequest `json:"native"`
+	}
+	if err := json.Unmarshal([]byte(imp.Native.Request), &native); err != nil {
+		return ids
+	}
+	assets := native.Assets
+	if native.Native != nil {
+		assets = native.Native.Assets
+	}
+	for _, asset := range assets {
+		switch {
+		case asset.Title != nil:
+			ids["title"] = asset.Id
+		case asset.Img != nil:
+			ids["image"] = asset.Id
+		case asset.Data != nil && asset.Data.Type == 1:
+			ids["sponsored"] = asset.Id
+		}
+	}
+	return ids
+}
+
+func buildNativeMarkup(camp CampaignAd, imp OpenRTBImp, format placementFormat) string {
+	ids := nativeRequestAssetIds(imp)
+	title := camp.Description
+	if runes := []rune(title); len(runes) > format.TitleLen {
+		title = strings.TrimSpace(string(runes[:format.TitleLen-3])) + "..."
+	}
+	native := NativeResponse{
+		Ver: "1.2",
+		Assets: []NativeResponseAsset{
+			{Id: ids["title"], Title: &NativeTitleAsset{Text: title}},
+			{Id: ids["image"], Img: &NativeImageAsset{Url: camp.Image, W: format.ImageWidth, H: format.ImageHeight}},
+			{Id: ids["sponsored"], Data: &NativeDataAsset{Value: camp.Company}},
+		},
+		Link: NativeLink{Url: camp.Link},
+	}
+	js, _ := json.Marshal(native)
+	return string(js)
+}
+
+// eligibleCampaigns returns the campaigns that can be sold to buyers in the
+// given country ordered by price, highest first
+func eligibleCampaigns(camps []CampaignAd, country string) []CampaignAd {
+	var res []CampaignAd
+	for _, camp := range camps {
+		// Buyers only get the campaigns that don't need the profile of the user
+		if camp.Fallback || camp.Price <= 0 || camp.IsTagTargeted || camp.IsExpTargeted {
+			continue
+		}
+		if len(camp.Geo) > 0 && (country == "" || !strings.Contains(camp.Geo, country)) {
+			continue
+		}
+		res = append(res, camp)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Price > res[j].Price
+	})
+	return res
+}
+
+func acceptsUsd(bidReq *OpenRTBBidRequest) bool {
+	return len(bidReq.Cur) == 0 || util.Contains[string](bidReq.Cur, "USD")
+}
+
+// hasBasicAdsConsent tells whether an ad can be sold for the request, which
+// needs the consent of the user when the GDPR applies
+func hasBasicAdsConsent(bidReq *OpenRTBBidRequest) bool {
+	if bidReq.Regs == nil || bidReq.Regs.Gdpr != 1 {
+		return true
+	}
+	if bidReq.User == nil || bidReq.User.Consent == "" {
+		return false
+	}
+	purposes, err := tcfPurposesConsent(bidReq.User.Consent)
+	if err != nil {
+		return false
+	}
+	for _, purpose := range tcfBasicAdsPurposes {
+		if !purposes[purpose] {
+			return false
+		}
+	}
+	return true
+}
+
+func ServeOpenRTB(w http.ResponseWriter, r *http.Request, buyer string, campaigns CampaignStore, images *imagePipeline, billing *inventoryBilling) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBidRequestSize)
+	var bidReq OpenRTBBidRequest
+	if err := json.NewDecoder(r.Body).Decode(&bidReq); err != nil || bidReq.Id == "" || len(bidReq.Imp) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if !acceptsUsd(&bidReq) || !hasBasicAdsConsent(&bidReq) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The user id of the request is set by the buyer, so the campaigns are
+	// fetched without a user to never target, or disclose, a profile
+	var country string
+	if bidReq.Device != nil && bidReq.Device.Ip != "" {
+		country = getCountryByIP(bidReq.Device.Ip)
+	}
+
+	camps, err := campaigns.FetchCampaigns(r.Context(), time.Now(), "")
+	if err != nil {
+		log.Warn("failed to fetch campaigns ", err)
+	}
+	camps = eligibleCampaigns(camps, country)
+	// Buyers render the images at the size of the format, so they only get
+	// the host rewrites
+	for i := range camps {
+		camps[i].Image = images.apply(camps[i].Image, "", 0)
+	}
+
+	// Each campaign can win a single impression of the request
+	var bids []OpenRTBBid
+	sold := make(map[string]bool)
+	for _, imp := range bidReq.Imp {
+		format, ok := openRTBPlacements[imp.TagId]
+		if !ok || imp.Native == nil {
+			continue
+		}
+		if imp.BidFloorCur != "" && imp.BidFloorCur != "USD" {
+			continue
+		}
+		for _, camp := range camps {
+			if sold[camp.Id] || float64(camp.Price) < imp.BidFloor {
+				continue
+			}
+			sold[camp.Id] = true
+			bidId := bidReq.Id + "-" + imp.Id
+			bids = append(bids, OpenRTBBid{
+				Id:    bidId,
+				ImpId: imp.Id,
+				Price: float64(camp.Price),
+				Adm:   buildNativeMarkup(camp, imp, format),
+				BUrl:  billing.noticeUrl(buyer, bidId, camp.Id),
+				CrId:  camp.Id,
+			})
+			break
+		}
+	}
+
+	if len(bids) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	js, err := json.Marshal(OpenRTBBidResponse{
+		Id:      bidReq.Id,
+		Cur:     "USD",
+		SeatBid: []OpenRTBSeatBid{{Seat: "dailydev", Bid: bids}},
+	})
+	if err != nil {
+		log.Error("failed to marshal json ", err)
+		http.Error(w, "Server Internal Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-openrtb-version", "2.6")
+	_, _ = w.Write(js)
+}
+
+// ServeBillingNotice records an impression won by a buyer, buyers call the
+// burl of the bid once the ad is rendered
+func ServeBillingNotice(w http.ResponseWriter, r *http.Request, billing *inventoryBilling) {
+	query := r.URL.Query()
+	buyer, bidId, campaignId := query.Get("buyer"), query.Get("bid"), query.Get("crid")
+	price, err := strconv.ParseFloat(query.Get("price"), 64)
+	_, known := billing.buyers[buyer]
+	if err != nil || price < 0 || !known || bidId == "" || campaignId == "" ||
+		!hmac.Equal([]byte(query.Get("sig")), []byte(billing.signature(buyer, bidId, campaignId))) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	recordInventoryImpression(r.Context(), buyer, price)
+	log.WithFields(log.Fields{
+		"buyer":    buyer,
+		"bid":      bidId,
+		"campaign": campaignId,
+		"price":    price,
+	}).Info("inventory impression")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OpenRTBHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/billing" && r.Method == "GET" {
+		ServeBillingNotice(w, r, h.billing)
+		return
+	}
+	if r.URL.Path == "/" && r.Method == "POST" {
+		buyer, ok := h.billing.authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ServeOpenRTB(w, r, buyer, h.campaigns, h.images, h.billing)
+		return
+	}
+
+	http.Error(w, "Not Found", http.StatusNotFound)
+}
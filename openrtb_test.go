@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nativeMarkup(title string) string {
+	js, _ := json.Marshal(map[string]interface{}{
+		"native": NativeResponse{
+			Assets: []NativeResponseAsset{
+				{Id: nativeAssetTitle, Title: &NativeTitleAsset{Text: title}},
+				{Id: nativeAssetImage, Img: &NativeImageAsset{Url: "https://image.com"}},
+				{Id: nativeAssetSponsored, Data: &NativeDataAsset{Value: "company"}},
+			},
+			Link:        NativeLink{Url: "https://link.com"},
+			ImpTrackers: []string{"https://pixel.com?price=${AUCTION_PRICE}"},
+		},
+	})
+	return string(js)
+}
+
+// newStubBidder starts a bidder that answers every bid request with the given
+// price or with no content when the price is 0
+func newStubBidder(t *testing.T, price float64, title string, notices chan string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			notices <- r.URL.String()
+			return
+		}
+
+		var req OpenRTBBidRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "2.6", r.Header.Get("x-openrtb-version"))
+		if price == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		res := OpenRTBBidResponse{
+			Id:  req.Id,
+			Cur: "USD",
+			SeatBid: []OpenRTBSeatBid{
+				{
+					Seat: "seat",
+					Bid: []OpenRTBBid{
+						{
+							Id:    "bid",
+							ImpId: req.Imp[0].Id,
+							Price: price,
+							NUrl:  server.URL + "/win?price=${AUCTION_PRICE}",
+							BUrl:  server.URL + "/bill?price=${AUCTION_PRICE}",
+							Adm:   nativeMarkup(title),
+						},
+					},
+				},
+			},
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	return server
+}
+
+// providersWithBidders returns the providers of the test config with the
+// bidders, all the requests come from the US
+func providersWithBidders(t *testing.T, bidders ...openRTBBidder) *adProviders {
+	originalCountry := getCountryCodeByIP
+	getCountryCodeByIP = func(ip string) string {
+		return "USA"
+	}
+	t.Cleanup(func() {
+		getCountryCodeByIP = originalCountry
+	})
+	providers := newAdProviders(testConfig.Providers)
+	providers.openRTBBidders = bidders
+	return providers
+}
+
+func TestBuildOpenRTBRequest(t *testing.T) {
+	providers := providersWithBidders(t)
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	req.Header.Set("x-forwarded-for", "8.8.8.8")
+	req.Header.Set("User-Agent", "ua")
+
+	bidReq := buildOpenRTBRequest(providers, req, "id", []string{"webdev", "go"})
+	assert.Equal(t, "id", bidReq.Id)
+	assert.Equal(t, 1, bidReq.At)
+	assert.Equal(t, &OpenRTBDevice{Ua: "ua", Ip: "8.8.8.8", Geo: &OpenRTBGeo{Country: "USA", Type: 2}}, bidReq.Device)
+	assert.Equal(t, &OpenRTBUser{Keywords: "webdev,go"}, bidReq.User)
+	assert.Len(t, bidReq.Imp, 1)
+
+	var native NativeRequest
+	assert.NoError(t, json.Unmarshal([]byte(bidReq.Imp[0].Native.Request), &native))
+	assert.Equal(t, "1.2", native.Ver)
+	assert.Len(t, native.Assets, 4)
+}
+
+func TestOpenRTBAuction(t *testing.T) {
+	imp := OpenRTBImp{Id: "1", BidFloor: 1}
+	bids := []openRTBBid{
+		{OpenRTBBid: OpenRTBBid{Id: "low", ImpId: "1", Price: 0.5, Adm: "adm"}},
+		{OpenRTBBid: OpenRTBBid{Id: "high", ImpId: "1", Price: 3, Adm: "adm"}},
+		{OpenRTBBid: OpenRTBBid{Id: "other", ImpId: "2", Price: 5, Adm: "adm"}},
+		{OpenRTBBid: OpenRTBBid{Id: "currency", ImpId: "1", Price: 4, Adm: "adm"}, Cur: "EUR"},
+		{OpenRTBBid: OpenRTBBid{Id: "mid", ImpId: "1", Price: 2, Adm: "adm"}},
+	}
+
+	winner := runOpenRTBAuction(imp, bids)
+	assert.NotNil(t, winner)
+	assert.Equal(t, "high", winner.Id)
+
+	assert.Nil(t, runOpenRTBAuction(OpenRTBImp{Id: "1", BidFloor: 10}, bids))
+}
+
+func TestOpenRTBAvailable(t *testing.T) {
+	notices := make(chan string, 2)
+	low := newStubBidder(t, 1.5, "low", make(chan string, 2))
+	defer low.Close()
+	high := newStubBidder(t, 2.5, "high", notices)
+	defer high.Close()
+	none := newStubBidder(t, 0, "", nil)
+	defer none.Close()
+	providers := providersWithBidders(t,
+		openRTBBidder{Name: "low", Endpoint: low.URL},
+		openRTBBidder{Name: "high", Endpoint: high.URL},
+		openRTBBidder{Name: "none", Endpoint: none.URL},
+	)
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	ad, err := fetchOpenRTB(providers, req, []string{"webdev"})
+	assert.Nil(t, err)
+	assert.Equal(t, &OpenRTBAd{
+		Ad: Ad{
+			Description: "high",
+			Image:       "https://image.com",
+			Link:        "https://link.com",
+			Source:      "high",
+			Company:     "company",
+			ProviderId:  "openrtb",
+		},
+		Pixel: []string{"https://pixel.com?price=2.5"},
+	}, ad)
+
+	received := make([]string, 0, 2)
+	for len(received) < 2 {
+		select {
+		case notice := <-notices:
+			received = append(received, notice)
+		case <-time.After(time.Second):
+			t.Fatal("win notices were not fired")
+		}
+	}
+	assert.ElementsMatch(t, []string{"/win?price=2.5", "/bill?price=2.5"}, received)
+}
+
+func TestOpenRTBNotAvailable(t *testing.T) {
+	none := newStubBidder(t, 0, "", nil)
+	defer none.Close()
+	providers := providersWithBidders(t, openRTBBidder{Name: "none", Endpoint: none.URL})
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	ad, err := fetchOpenRTB(providers, req, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, ad)
+}
+
+func TestNewOpenRTBBidders(t *testing.T) {
+	assert.Equal(t, []openRTBBidder{
+		{Name: "a", Endpoint: "https://a.com/bid"},
+		{Name: "b", Endpoint: "https://b.com/bid?x=1"},
+	}, newOpenRTBBidders(map[string]string{"b": "https://b.com/bid?x=1", "a": "https://a.com/bid"}))
+	assert.Nil(t, newOpenRTBBidders(nil))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/afex/hystrix-go/hystrix"
+	log "github.com/sirupsen/logrus"
+)
+
+// personalDataTables lists every table that holds rows keyed by user_id.
+// Tables that store personal data must be added here to be erased.
+var personalDataTables = []string{
+	"user_tags",
+	"user_experience_levels",
+	"segments",
+}
+
+type UserTagExport struct {
+	Tag       string
+	LastRead  string
+	ReadCount int
+	Score     float64
+}
+
+type UserExperienceLevelExport struct {
+	ExperienceLevel string
+	UpdatedAt       string
+}
+
+type UserDataExport struct {
+	UserId          string
+	Tags            []UserTagExport
+	ExperienceLevel *UserExperienceLevelExport
+	Segment         *string
+}
+
+// EraseUser deletes all the personal data of the user in a single transaction
+func (s *mysqlStore) EraseUser(ctx context.Context, userId string) error {
+	return hystrix.DoC(ctx, hystrixDb,
+		func(ctx context.Context) error {
+			tx, err := s.db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			for _, table := range personalDataTables {
+				if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = ?", userId); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		}, nil)
+}
+
+func (s *mysqlStore) ExportUserData(ctx context.Context, userId string) (*UserDataExport, error) {
+	res := &UserDataExport{UserId: userId, Tags: []UserTagExport{}}
+	err := hystrix.DoC(ctx, hystrixDb,
+		func(ctx context.Context) error {
+			rows, err := s.db.QueryContext(ctx, "SELECT tag, last_read, read_count, score FROM user_tags WHERE user_id = ? ORDER BY tag", userId)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var tag UserTagExport
+				if err := rows.Scan(&tag.Tag, &tag.LastRead, &tag.ReadCount, &tag.Score); err != nil {
+					return err
+				}
+				res.Tags = append(res.Tags, tag)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			var level UserExperienceLevelExport
+			err = s.db.QueryRowContext(ctx, "SELECT experience_level, d_update FROM user_experience_levels WHERE user_id = ?", userId).Scan(&level.ExperienceLevel, &level.UpdatedAt)
+			switch {
+			case err == nil:
+				res.ExperienceLevel = &level
+			case !errors.Is(err, sql.ErrNoRows):
+				return err
+			}
+
+			var segment string
+			err = s.db.QueryRowContext(ctx, "SELECT segment FROM segments WHERE user_id = ?", userId).Scan(&segment)
+			switch {
+			case err == nil:
+				res.Segment = &segment
+			case !errors.Is(err, sql.ErrNoRows):
+				return err
+			}
+			return nil
+		}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func isPrivacyRequestAuthorized(r *http.Request, apiToken string) bool {
+	if apiToken == "" {
+		return false
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1
+}
+
+func ServeUserDataExport(w http.ResponseWriter, r *http.Request, store PrivacyStore, userId string) {
+	data, err := store.ExportUserData(r.Context(), userId)
+	if err != nil {
+		log.Error("failed to export user data ", err)
+		http.Error(w, "Server Internal Error", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := marshalJSON(data)
+	if err != nil {
+		log.Error("failed to marshal json ", err)
+		http.Error(w, "Server Internal Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(js)
+}
+
+type PrivacyHandler struct {
+	token string
+	store PrivacyStore
+}
+
+func (h *PrivacyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isPrivacyRequestAuthorized(r, h.token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var head string
+	head, r.URL.Path = shiftPath(r.URL.Path)
+	if head == "users" && r.Method == "GET" {
+		userId, tail := shiftPath(r.URL.Path)
+		if userId != "" && tail == "/" {
+			ServeUserDataExport(w, r, h.store, userId)
+			return
+		}
+	}
+
+	http.Error(w, "Not Found", http.StatusNotFound)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPrivacyRequest(t *testing.T, path string, token string) *http.Request {
+	req, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func privacyApp(t *testing.T, token string) *App {
+	cfg := *testConfig
+	cfg.Privacy.ApiToken = token
+	stores := newTestStores()
+	require.NoError(t, addOrUpdateUserTags(context.Background(), stores.UserTags, "1", []string{"webdev", "webdev"}))
+	return createApp(&cfg, stores)
+}
+
+func TestUserDataExportUnauthorized(t *testing.T) {
+	for _, token := range []string{"", "wrong"} {
+		rr := httptest.NewRecorder()
+		privacyApp(t, "secret").ServeHTTP(rr, newPrivacyRequest(t, "/privacy/users/1", token))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, "wrong status code")
+	}
+}
+
+func TestUserDataExportDisabled(t *testing.T) {
+	rr := httptest.NewRecorder()
+	privacyApp(t, "").ServeHTTP(rr, newPrivacyRequest(t, "/privacy/users/1", ""))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "wrong status code")
+}
+
+func TestUserDataExport(t *testing.T) {
+	rr := httptest.NewRecorder()
+	privacyApp(t, "secret").ServeHTTP(rr, newPrivacyRequest(t, "/privacy/users/1", "secret"))
+	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
+
+	var actual map[string]interface{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
+	assert.Equal(t, "1", actual["userId"])
+	assert.Equal(t, "webdev", actual["tags"].([]interface{})[0].(map[string]interface{})["tag"])
+}
+
+func TestEraseUser(t *testing.T) {
+	db := openTestDatabase(t)
+
+	_, err := db.Exec("INSERT INTO user_tags (user_id, tag) VALUES ('1', 'webdev'), ('1', 'php'), ('2', 'webdev')")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('1', 'MORE_THAN_4_YEARS'), ('2', 'MORE_THAN_10_YEARS')")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO segments (user_id, segment) VALUES ('1', 'python')")
+	require.NoError(t, err)
+
+	require.NoError(t, newMySQLTestStore(t, db).EraseUser(context.Background(), "1"))
+
+	for _, table := range personalDataTables {
+		var count int
+		require.NoError(t, db.QueryRow("SELECT count(*) FROM "+table+" WHERE user_id = '1'").Scan(&count))
+		assert.Equal(t, 0, count, table)
+	}
+	var count int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM user_tags WHERE user_id = '2'").Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestExportUserData(t *testing.T) {
+	db := openTestDatabase(t)
+
+	_, err := db.Exec("INSERT INTO user_tags (user_id, tag, last_read) VALUES ('1', 'webdev', '2021-01-12 08:54:07')")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('1', 'MORE_THAN_4_YEARS')")
+	require.NoError(t, err)
+
+	store := newMySQLTestStore(t, db)
+	data, err := store.ExportUserData(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", data.UserId)
+	assert.Equal(t, []UserTagExport{{Tag: "webdev", LastRead: "2021-01-12 08:54:07", ReadCount: 1, Score: 1}}, data.Tags)
+	assert.Equal(t, "MORE_THAN_4_YEARS", data.ExperienceLevel.ExperienceLevel)
+	assert.Nil(t, data.Segment)
+
+	data, err = store.ExportUserData(context.Background(), "2")
+	require.NoError(t, err)
+	assert.Equal(t, &UserDataExport{UserId: "2", Tags: []UserTagExport{}}, data)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	log "github.com/sirupsen/logrus"
+)
+
+// userProfile is the targeting data of a user
+type userProfile struct {
+	tags            []string
+	experienceLevel string
+}
+
+type profileEntry struct {
+	userId  string
+	profile userProfile
+	expires time.Time
+	// invalidated entries have no profile, they mark the users whose profile
+	// changed until it's loaded again
+	invalidated bool
+}
+
+// profileLoad tells how to load the profile of a missed user and is passed to
+// set along with the loaded profile
+type profileLoad struct {
+	generation uint64
+	// primary is set on the first load after an invalidation, the replica
+	// may not have the change yet and its profile would be cached for the
+	// whole ttl
+	primary bool
+}
+
+// profileCache is an LRU cache of the user profiles whose entries expire after
+// the ttl. Profiles change only when the workers process the events of the
+// user, so the workers publish invalidations and every serving instance
+// evicts the users from its cache. A zero size disables the cache.
+type profileCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	entries map[string]*list.Element
+	// recent has the most recently used entries at the front
+	recent *list.List
+	// generation changes on every invalidation, so profiles loaded before
+	// the invalidation aren't cached after it
+	generation uint64
+	now        func() time.Time
+}
+
+func newProfileCache(cfg ProfileCacheConfig) *profileCache {
+	return &profileCache{
+		ttl:     cfg.TTL,
+		maxSize: cfg.Size,
+		entries: make(map[string]*list.Element),
+		recent:  list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the cached profile of the user, on a miss it returns how to
+// load the profile
+func (c *profileCache) get(userId string) (userProfile, profileLoad, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[userId]
+	if !ok {
+		return userProfile{}, profileLoad{generation: c.generation}, false
+	}
+	entry := elem.Value.(*profileEntry)
+	// Invalidated users are kept until their profile is loaded again, even
+	// past the ttl, since the replica may lag by more than it
+	if entry.invalidated {
+		return userProfile{}, profileLoad{generation: c.generation, primary: true}, false
+	}
+	if c.now().After(entry.expires) {
+		c.remove(elem)
+		return userProfile{}, profileLoad{generation: c.generation}, false
+	}
+	c.recent.MoveToFront(elem)
+	return entry.profile, profileLoad{generation: c.generation}, true
+}
+
+func (c *profileCache) set(userId string, profile userProfile, load profileLoad) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if load.generation != c.generation {
+		return
+	}
+	c.put(&profileEntry{userId: userId, profile: profile, expires: c.now().Add(c.ttl)})
+}
+
+// invalidate evicts the users, their next request loads the profile again
+// from the primary. Users that aren't cached are marked too, the profile of
+// their next request would otherwise come from the replica.
+func (c *profileCache) invalidate(userIds ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	if c.maxSize <= 0 {
+		return
+	}
+	for _, userId := range userIds {
+		c.put(&profileEntry{userId: userId, invalidated: true})
+	}
+}
+
+// put adds the entry as the most recently used one, must be called with the
+// mutex held
+func (c *profileCache) put(entry *profileEntry) {
+	if elem, ok := c.entries[entry.userId]; ok {
+		elem.Value = entry
+		c.recent.MoveToFront(elem)
+		return
+	}
+	if c.recent.Len() >= c.maxSize {
+		c.remove(c.recent.Back())
+	}
+	c.entries[entry.userId] = c.recent.PushFront(entry)
+}
+
+// remove must be called with the mutex held
+func (c *profileCache) remove(elem *list.Element) {
+	c.recent.Remove(elem)
+	delete(c.entries, elem.Value.(*profileEntry).userId)
+}
+
+type ProfileInvalidationMessage struct {
+	UserIds []string `json:"userIds"`
+}
+
+// newProfileInvalidationPublisher publishes the users whose profile changed
+// to the invalidation topic
+func newProfileInvalidationPublisher(topic *pubsub.Topic) func(ctx context.Context, userIds []string) error {
+	return func(ctx context.Context, userIds []string) error {
+		js, err := json.Marshal(ProfileInvalidationMessage{UserIds: userIds})
+		if err != nil {
+			return err
+		}
+		_, err = topic.Publish(ctx, &pubsub.Message{Data: js}).Get(ctx)
+		return err
+	}
+}
+
+// subscribeProfileInvalidations creates the subscription of this instance to
+// the invalidation topic, every instance needs its own subscription to
+// receive all the invalidations. Subscriptions of instances that went away
+// without deleting them expire after a day.
+func subscribeProfileInvalidations(ctx context.Context, client *pubsub.Client, topic string) (*pubsub.Subscription, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	// Instances keep their hostname across restarts, so the subscription
+	// may already exist
+	sub := client.Subscription(fmt.Sprintf("%s-%s", topic, hostname))
+	exists, err := sub.Exists(ctx)
+	if err != nil || exists {
+		return sub, err
+	}
+	return client.CreateSubscription(ctx, sub.ID(), pubsub.SubscriptionConfig{
+		Topic:             client.Topic(topic),
+		AckDeadline:       10 * time.Second,
+		RetentionDuration: 10 * time.Minute,
+		ExpirationPolicy:  24 * time.Hour,
+	})
+}
+
+// receiveProfileInvalidations subscribes to the invalidations and applies them
+// until the context is cancelled. Cached profiles still expire after their
+// TTL, so failures are only logged instead of stopping the server.
+func receiveProfileInvalidations(ctx context.Context, client *pubsub.Client, topic string, options consumerOptions, cache *profileCache) {
+	sub, err := subscribeProfileInvalidations(ctx, client, topic)
+	if err != nil {
+		log.Error("failed to subscribe to profile invalidations, cached profiles only expire after their ttl ", err)
+		return
+	}
+	if err := runProfileInvalidations(ctx, client, sub, options, cache); err != nil {
+		log.Error("stopped receiving profile invalidations, cached profiles only expire after their ttl ", err)
+	}
+}
+
+// runProfileInvalidations evicts the invalidated users from the cache until
+// the context is cancelled and then deletes the subscription of the instance
+func runProfileInvalidations(ctx context.Context, client *pubsub.Client, sub *pubsub.Subscription, options consumerOptions, cache *profileCache) error {
+	// A lost invalidation only keeps a profile until it expires, so failed
+	// messages aren't worth a dead letter
+	options.DeadLetterTopic = ""
+	c := newConsumer(client, sub.ID(), options, func(ctx context.Context, log *log.Entry, data ProfileInvalidationMessage) error {
+		cache.invalidate(data.UserIds...)
+		return nil
+	})
+	err := c.run(ctx)
+
+	deleteCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if deleteErr := sub.Delete(deleteCtx); deleteErr != nil {
+		log.Warn("failed to delete profile invalidation subscription ", deleteErr)
+	}
+	return err
+}
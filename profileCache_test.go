@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileCache(t *testing.T) {
+	cache := newProfileCache(ProfileCacheConfig{Size: 2, TTL: time.Minute})
+	now := time.Now()
+	cache.now = func() time.Time {
+		return now
+	}
+
+	_, generation, ok := cache.get("1")
+	assert.False(t, ok)
+	cache.set("1", userProfile{experienceLevel: "MORE_THAN_4_YEARS"}, generation)
+	cache.set("2", userProfile{experienceLevel: "NOT_ENGINEER"}, generation)
+	profile, _, ok := cache.get("1")
+	require.True(t, ok)
+	assert.Equal(t, "MORE_THAN_4_YEARS", profile.experienceLevel)
+
+	cache.set("3", userProfile{}, generation)
+	_, _, ok = cache.get("2")
+	assert.False(t, ok, "least recently used profile should be evicted")
+	_, _, ok = cache.get("1")
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute * 2)
+	_, _, ok = cache.get("1")
+	assert.False(t, ok, "profile should expire")
+}
+
+func TestProfileCacheInvalidate(t *testing.T) {
+	cache := newProfileCache(ProfileCacheConfig{Size: 10, TTL: time.Minute})
+	_, generation, _ := cache.get("1")
+	cache.set("1", userProfile{tags: []string{"go"}}, generation)
+	cache.set("2", userProfile{tags: []string{"rust"}}, generation)
+
+	cache.invalidate("1")
+	_, load, ok := cache.get("1")
+	assert.False(t, ok)
+	assert.True(t, load.primary, "invalidated profile should be loaded from the primary")
+	_, load, ok = cache.get("2")
+	assert.True(t, ok)
+	assert.False(t, load.primary)
+
+	cache.set("1", userProfile{tags: []string{"go"}}, generation)
+	_, _, ok = cache.get("1")
+	assert.False(t, ok, "profile loaded before the invalidation should not be cached")
+}
+
+func TestProfileCacheLaggingReplica(t *testing.T) {
+	ctx := context.Background()
+	stores := newStores(newMemoryStore())
+	cache := newProfileCache(ProfileCacheConfig{Size: 10, TTL: time.Minute})
+	// The replica still has the tags the users had before the invalidation
+	stores.UserTags = userTagsFunc(func(ctx context.Context, userId string) ([]string, error) {
+		if isPrimaryRead(ctx) {
+			return []string{"rust"}, nil
+		}
+		return []string{"go"}, nil
+	})
+
+	tags, _ := getUserTargeting(ctx, stores, cache, "1")
+	assert.Equal(t, []string{"go"}, tags)
+
+	cache.invalidate("1", "2")
+	for _, userId := range []string{"1", "2"} {
+		tags, _ = getUserTargeting(ctx, stores, cache, userId)
+		assert.Equal(t, []string{"rust"}, tags, "first load after an invalidation should read the primary")
+		profile, _, ok := cache.get(userId)
+		require.True(t, ok)
+		assert.Equal(t, []string{"rust"}, profile.tags)
+	}
+}
+
+func TestProfileCacheDisabled(t *testing.T) {
+	cache := newProfileCache(ProfileCacheConfig{})
+	_, generation, _ := cache.get("1")
+	cache.set("1", userProfile{}, generation)
+	_, _, ok := cache.get("1")
+	assert.False(t, ok)
+}
+
+func TestProfileCacheUserTargeting(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	stores := newStores(store)
+	cache := newProfileCache(ProfileCacheConfig{Size: 10, TTL: time.Minute})
+	require.NoError(t, addOrUpdateUserTags(ctx, store, "1", []string{"go"}))
+	require.NoError(t, store.SetExperienceLevel(ctx, "1", "MORE_THAN_4_YEARS"))
+
+	tags, level := getUserTargeting(ctx, stores, cache, "1")
+	assert.Equal(t, []string{"go"}, tags)
+	assert.Equal(t, "MORE_THAN_4_YEARS", level)
+
+	require.NoError(t, store.SetExperienceLevel(ctx, "1", "MORE_THAN_6_YEARS"))
+	_, level = getUserTargeting(ctx, stores, cache, "1")
+	assert.Equal(t, "MORE_THAN_4_YEARS", level, "profile should be cached")
+
+	cache.invalidate("1")
+	_, level = getUserTargeting(ctx, stores, cache, "1")
+	assert.Equal(t, "MORE_THAN_6_YEARS", level)
+
+	stores.UserTags = userTagsFunc(func(ctx context.Context, userId string) ([]string, error) {
+		return nil, errors.New("error")
+	})
+	getUserTargeting(ctx, stores, cache, "2")
+	_, _, ok := cache.get("2")
+	assert.False(t, ok, "failed loads should not be cached")
+}
+
+func TestWorkersInvalidateProfiles(t *testing.T) {
+	ctx := context.Background()
+	entry := log.NewEntry(log.StandardLogger())
+	var invalidated []string
+	workers := &Workers{
+		stores: newStores(newMemoryStore()),
+		publishInvalidations: func(ctx context.Context, userIds []string) error {
+			invalidated = append(invalidated, userIds...)
+			return nil
+		},
+	}
+
+	require.NoError(t, workers.AddOrUpdateUsersTags(ctx, map[string]map[string]int{"2": {"go": 1}, "1": {"go": 1}}))
+	require.NoError(t, workers.CreateUserExperienceLevel(ctx, entry, UserCreatedMessage{User: user{Id: "3", ExperienceLevel: "MORE_THAN_4_YEARS"}}))
+	require.NoError(t, workers.CreateUserExperienceLevel(ctx, entry, UserCreatedMessage{User: user{Id: "4"}}))
+	require.NoError(t, workers.UpdateUserExperienceLevel(ctx, entry, UserUpdatedMessage{NewProfile: user{Id: "5", ExperienceLevel: "NOT_ENGINEER"}}))
+	require.NoError(t, workers.UpdateUserExperienceLevel(ctx, entry, UserUpdatedMessage{NewProfile: user{Id: "6"}}))
+	assert.Equal(t, []string{"1", "2", "3", "5", "6"}, invalidated)
+
+	workers.publishInvalidations = func(ctx context.Context, userIds []string) error {
+		return errors.New("error")
+	}
+	assert.NoError(t, workers.UpdateUserExperienceLevel(ctx, entry, UserUpdatedMessage{NewProfile: user{Id: "1"}}),
+		"failed invalidations should not fail the message")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// adProviders has the settings of the calls to the third-party ad providers
+// and the no-fill cache they share, every fetcher receives it from the handler
+type adProviders struct {
+	cache      *ttlCache
+	ipPolicies map[string]ipPolicy
+	// countryIps maps ISO-3166-1 alpha-3 codes to the representative ip of
+	// the country
+	countryIps      map[string]string
+	ethicaladsToken string
+	openRTBBidders  []openRTBBidder
+	openRTBFloor    float64
+	openRTBTimeout  time.Duration
+}
+
+func newAdProviders(cfg ProvidersConfig) *adProviders {
+	p := &adProviders{
+		cache:           newProviderCache(cfg.CacheTTL),
+		ipPolicies:      cfg.IpPolicies,
+		countryIps:      make(map[string]string, len(cfg.CountryIps)),
+		ethicaladsToken: cfg.EthicalAds.Token,
+		openRTBBidders:  newOpenRTBBidders(cfg.OpenRTB.Bidders),
+		openRTBFloor:    cfg.OpenRTB.Floor,
+		openRTBTimeout:  cfg.OpenRTB.Timeout,
+	}
+	for country, ip := range cfg.CountryIps {
+		p.countryIps[strings.ToUpper(country)] = ip
+	}
+	return p
+}
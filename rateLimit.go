@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimit is a token bucket that refills PerMinute tokens every minute and
+// holds up to Burst tokens
+type rateLimit struct {
+	PerMinute int `yaml:"perMinute" env:"PER_MINUTE"`
+	Burst     int `yaml:"burst" env:"BURST"`
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per key in memory, so limits are enforced
+// per instance
+type rateLimiter struct {
+	mutex          sync.Mutex
+	limits         map[string]rateLimit
+	entries        map[string]*rateLimiterEntry
+	idle           time.Duration
+	trustedProxies int
+	lastSweep      time.Time
+	now            func() time.Time
+}
+
+func newRateLimiter(limits map[string]rateLimit, idle time.Duration, trustedProxies int) *rateLimiter {
+	return &rateLimiter{
+		limits:         limits,
+		entries:        make(map[string]*rateLimiterEntry),
+		idle:           idle,
+		trustedProxies: trustedProxies,
+		now:            time.Now,
+	}
+}
+
+// sweep drops the idle buckets, must be called with the mutex held
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idle {
+		return
+	}
+	l.lastSweep = now
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastSeen) >= l.idle {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// allow takes a token from the bucket of every key of the placement and
+// returns how long the client should wait when one of them is empty
+func (l *rateLimiter) allow(placement string, keys ...string) (bool, time.Duration) {
+	limit, ok := l.limits[placement]
+	if !ok || limit.PerMinute <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	// Reserve from the buckets in the order of the keys, the ip first, and
+	// cancel them all when one is empty so a throttled user doesn't drain the
+	// bucket of its ip and the other way around. The keys after an empty
+	// bucket get none, so a client rotating its user ids only adds buckets
+	// while its ip has tokens.
+	var delay time.Duration
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	for _, key := range keys {
+		key = placement + ":" + key
+		entry, ok := l.entries[key]
+		if !ok {
+			entry = &rateLimiterEntry{limiter: rate.NewLimiter(rate.Limit(float64(limit.PerMinute)/60), limit.Burst)}
+			l.entries[key] = entry
+		}
+		entry.lastSeen = now
+
+		reservation := entry.limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+		if !reservation.OK() {
+			delay = time.Minute
+		} else if d := reservation.DelayFrom(now); d > delay {
+			delay = d
+		}
+		if delay > 0 {
+			break
+		}
+	}
+	if delay > 0 {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+		return false, delay
+	}
+	return true, 0
+}
+
+// clientIpAddress is the address of the client as seen by the first of the
+// trusted proxies. Every proxy appends the address it received the request
+// from to X-Forwarded-For, so only the entries the trusted proxies appended
+// can't be forged by the client.
+func clientIpAddress(r *http.Request, trustedProxies int) string {
+	var forwarded []string
+	for _, header := range r.Header.Values("x-forwarded-for") {
+		for _, ip := range strings.Split(header, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				forwarded = append(forwarded, ip)
+			}
+		}
+	}
+
+	ip := r.RemoteAddr
+	if trustedProxies > 0 && len(forwarded) > 0 {
+		// With fewer entries than proxies the first proxy got no header
+		ip = forwarded[max(len(forwarded)-trustedProxies, 0)]
+	}
+	// RemoteAddr has the port of the connection
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// allowRequest limits the requests of the placement by ip and da2 user. The
+// ip is the one the trusted proxies saw, since the client controls the
+// cookie and the start of X-Forwarded-For. Throttled requests get a 429 with
+// the time to wait before retrying.
+func (l *rateLimiter) allowRequest(w http.ResponseWriter, r *http.Request, placement string) bool {
+	var keys []string
+	ip := clientIpAddress(r, l.trustedProxies)
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	if cookie, _ := r.Cookie("da2"); cookie != nil && cookie.Value != "" {
+		keys = append(keys, "user:"+cookie.Value)
+	}
+
+	ok, delay := l.allow(placement, keys...)
+	if ok {
+		return true
+	}
+
+	recordPlacementMetric(r.Context(), placement, rateLimitedRequests)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	return false
+}
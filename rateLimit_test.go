@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(map[string]rateLimit{
+		"feed":   {PerMinute: 60, Burst: 2},
+		"toilet": {PerMinute: 0, Burst: 0},
+	}, time.Minute, 1)
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.allow("feed", "ip:1.1.1.1", "user:1")
+		assert.True(t, ok)
+	}
+	ok, delay := limiter.allow("feed", "ip:1.1.1.1", "user:1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	ok, _ = limiter.allow("feed", "ip:1.1.1.1", "user:2")
+	assert.False(t, ok, "ip should be throttled for every user")
+	ok, _ = limiter.allow("feed", "ip:2.2.2.2", "user:3")
+	assert.True(t, ok, "other clients should not be throttled")
+	ok, _ = limiter.allow("post", "ip:1.1.1.1", "user:1")
+	assert.True(t, ok, "placements without a limit should not be throttled")
+	ok, _ = limiter.allow("toilet", "ip:1.1.1.1", "user:1")
+	assert.True(t, ok, "disabled placements should not be throttled")
+
+	ok, _ = limiter.allow("feed", "ip:2.2.2.2", "user:2")
+	assert.True(t, ok, "rejected requests should not drain the other buckets")
+
+	now = now.Add(time.Second)
+	ok, _ = limiter.allow("feed", "ip:1.1.1.1", "user:1")
+	assert.True(t, ok, "bucket should refill")
+
+	now = now.Add(time.Minute)
+	limiter.allow("feed", "ip:3.3.3.3")
+	assert.Len(t, limiter.entries, 1, "idle buckets should be dropped")
+}
+
+func TestRateLimiterRotatingUsers(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(map[string]rateLimit{"feed": {PerMinute: 60, Burst: 20}}, time.Minute, 1)
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < 1000; i++ {
+		limiter.allow("feed", "ip:1.1.1.1", "user:"+strconv.Itoa(i))
+	}
+	assert.Len(t, limiter.entries, 21, "throttled ips should not add user buckets")
+}
+
+func TestAdRequestRateLimited(t *testing.T) {
+	fetchBsa = bsaNotAvailable
+	defer func() {
+		fetchBsa = originalFetchBsa
+	}()
+
+	cfg := *testConfig
+	cfg.RateLimits.Placements = map[string]rateLimit{"toilet": {PerMinute: 1, Burst: 1}}
+	router := createApp(&cfg, newTestStores())
+	serve := func(ip string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/a/toilet", nil)
+		assert.Nil(t, err)
+		setBrowserHeaders(req)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, serve("1.1.1.1").Code)
+	rr := serve("1.1.1.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve("2.2.2.2").Code)
+}
+
+func TestClientIpAddress(t *testing.T) {
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", clientIpAddress(req, 1), "requests without a proxy should use the connection")
+
+	req.Header.Set("x-forwarded-for", "1.1.1.1, 2.2.2.2, 3.3.3.3")
+	assert.Equal(t, "3.3.3.3", clientIpAddress(req, 1))
+	assert.Equal(t, "2.2.2.2", clientIpAddress(req, 2))
+	assert.Equal(t, "1.1.1.1", clientIpAddress(req, 5))
+	assert.Equal(t, "10.0.0.1", clientIpAddress(req, 0))
+
+	req.Header.Add("x-forwarded-for", "4.4.4.4")
+	assert.Equal(t, "4.4.4.4", clientIpAddress(req, 1), "every header should be read")
+}
+
+func TestAdRequestRateLimitedSpoofedIp(t *testing.T) {
+	fetchBsa = bsaNotAvailable
+	defer func() {
+		fetchBsa = originalFetchBsa
+	}()
+
+	cfg := *testConfig
+	cfg.RateLimits.Placements = map[string]rateLimit{"toilet": {PerMinute: 1, Burst: 1}}
+	router := createApp(&cfg, newTestStores())
+	serve := func(spoofed string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/a/toilet", nil)
+		assert.Nil(t, err)
+		setBrowserHeaders(req)
+		// The load balancer appends the address of the client
+		req.Header.Set("x-forwarded-for", spoofed+", 1.1.1.1")
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, serve("5.5.5.5").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("6.6.6.6").Code, "a client rotating X-Forwarded-For should still be throttled")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// replicaHealth checks the replica periodically, reads fall back to the
+// primary while the replica is unhealthy
+type replicaHealth struct {
+	healthy  atomic.Bool
+	check    func(ctx context.Context) error
+	interval time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newReplicaHealth checks the replica once before returning, so the first
+// reads already know where to go, and then every interval
+func newReplicaHealth(check func(ctx context.Context) error, interval time.Duration) *replicaHealth {
+	h := &replicaHealth{
+		check:    check,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	// The replica starts unhealthy, so a failed first check is logged here
+	if err := h.update(); err != nil {
+		log.Warn("replica is unhealthy, serving reads from the primary ", err)
+	}
+	go h.run()
+	return h
+}
+
+func (h *replicaHealth) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			_ = h.update()
+		}
+	}
+}
+
+func (h *replicaHealth) update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+
+	if err := h.check(ctx); err != nil {
+		h.markUnhealthy(err)
+		return err
+	}
+	if !h.healthy.Swap(true) {
+		log.Info("replica is healthy, serving reads from the replica")
+	}
+	return nil
+}
+
+// markUnhealthy sends the reads to the primary until the next successful check
+func (h *replicaHealth) markUnhealthy(err error) {
+	if h.healthy.Swap(false) {
+		log.Warn("replica is unhealthy, serving reads from the primary ", err)
+	}
+}
+
+func (h *replicaHealth) isHealthy() bool {
+	return h.healthy.Load()
+}
+
+func (h *replicaHealth) stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// errReplicaPrivilege is the MySQL error of a user without the privilege to
+// read the replication status
+const errReplicaPrivilege = 1227
+
+// checkReplica pings the replica and, when maxLag is set, makes sure it
+// doesn't lag behind the primary by more than maxLag. A database that isn't
+// replicating has no lag.
+func checkReplica(ctx context.Context, replica *sql.DB, maxLag time.Duration) error {
+	if err := replica.PingContext(ctx); err != nil {
+		return err
+	}
+	if maxLag <= 0 {
+		return nil
+	}
+
+	rows, err := replica.QueryContext(ctx, "SHOW SLAVE STATUS")
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errReplicaPrivilege {
+		return fmt.Errorf("the replica user needs the REPLICATION CLIENT privilege to check the lag, or set maxLag to 0: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		return rows.Err()
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" && column != "Seconds_Behind_Source" {
+			continue
+		}
+		// The lag is null while the replication is stopped
+		if values[i] == nil {
+			return fmt.Errorf("replication is not running")
+		}
+		var seconds int64
+		if _, err := fmt.Sscan(string(values[i]), &seconds); err != nil {
+			return err
+		}
+		if lag := time.Duration(seconds) * time.Second; lag > maxLag {
+			return fmt.Errorf("replica lags %v behind the primary", lag)
+		}
+		return nil
+	}
+	return fmt.Errorf("replica lag is unknown")
+}
+
+// runRead runs the query on the statements under the breaker. The query is
+// cancelled when the breaker gives up on it, so a slow database doesn't keep
+// the connection busy, and its late result is dropped.
+func runRead[T any](ctx context.Context, breaker string, stmts *mysqlReadStmts, query func(ctx context.Context, stmts *mysqlReadStmts) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	output := make(chan T, 1)
+	errs := hystrix.GoC(ctx, breaker,
+		func(ctx context.Context) error {
+			res, err := query(ctx, stmts)
+			if err != nil {
+				return err
+			}
+			output <- res
+			return nil
+		}, nil)
+	select {
+	case out := <-output:
+		return out, nil
+	case err := <-errs:
+		var zero T
+		return zero, err
+	}
+}
+
+type primaryReadKey struct{}
+
+// withPrimaryRead sends the reads of the context to the primary, for data
+// that changed too recently to trust the replica with
+func withPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+func isPrimaryRead(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadKey{}).(bool)
+	return primary
+}
+
+// readReplicated runs the query on the replica while it's healthy and falls
+// back to the primary when there's no replica or it fails or times out. The
+// replica has its own breaker and timeout, so a slow replica leaves the whole
+// budget of the db breaker to the primary and never opens it.
+func readReplicated[T any](ctx context.Context, s *mysqlStore, query func(ctx context.Context, stmts *mysqlReadStmts) (T, error)) (T, error) {
+	if s.replica != nil && s.replicaHealth.isHealthy() && !isPrimaryRead(ctx) {
+		res, err := runRead(ctx, hystrixReplica, s.replica, query)
+		// There's no point in falling back once the request is gone
+		if err == nil || ctx.Err() != nil {
+			return res, err
+		}
+		s.replicaHealth.markUnhealthy(err)
+	}
+	return runRead(ctx, hystrixDb, s.primary, query)
+}
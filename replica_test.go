@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaHealth(t *testing.T) {
+	var checkErr error
+	h := newReplicaHealth(func(ctx context.Context) error {
+		return checkErr
+	}, time.Hour)
+	defer h.stop()
+	assert.True(t, h.isHealthy())
+
+	checkErr = errors.New("lag")
+	assert.Equal(t, checkErr, h.update())
+	assert.False(t, h.isHealthy())
+
+	checkErr = nil
+	assert.NoError(t, h.update())
+	assert.True(t, h.isHealthy())
+
+	h.markUnhealthy(errors.New("error"))
+	assert.False(t, h.isHealthy())
+}
+
+func TestReplicaReadFallback(t *testing.T) {
+	store := &mysqlStore{
+		primary: &mysqlReadStmts{},
+		replica: &mysqlReadStmts{},
+		replicaHealth: newReplicaHealth(func(ctx context.Context) error {
+			return nil
+		}, time.Hour),
+	}
+	defer store.replicaHealth.stop()
+
+	var reads []*mysqlReadStmts
+	var replicaErr error
+	read := func(ctx context.Context) (string, error) {
+		return readReplicated(ctx, store, func(ctx context.Context, stmts *mysqlReadStmts) (string, error) {
+			reads = append(reads, stmts)
+			if stmts == store.replica {
+				return "replica", replicaErr
+			}
+			return "primary", nil
+		})
+	}
+
+	res, err := read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "replica", res)
+	assert.Equal(t, []*mysqlReadStmts{store.replica}, reads, "healthy replica should serve the reads")
+
+	reads = nil
+	res, err = read(withPrimaryRead(context.Background()))
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res)
+	assert.Equal(t, []*mysqlReadStmts{store.primary}, reads, "primary reads should skip the replica")
+
+	reads = nil
+	replicaErr = errors.New("error")
+	res, err = read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res)
+	assert.Equal(t, []*mysqlReadStmts{store.replica, store.primary}, reads, "failed reads should fall back to the primary")
+
+	reads = nil
+	_, err = read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []*mysqlReadStmts{store.primary}, reads, "unhealthy replica should be skipped")
+
+	store.replica = nil
+	reads = nil
+	_, err = read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []*mysqlReadStmts{store.primary}, reads)
+}
+
+func TestReplicaReadTimeout(t *testing.T) {
+	configureHystrix(map[string]BreakerConfig{hystrixReplica: {Timeout: 10, MaxConcurrentRequests: 10}})
+	defer configureHystrix(testConfig.Hystrix)
+	store := &mysqlStore{
+		primary: &mysqlReadStmts{},
+		replica: &mysqlReadStmts{},
+		replicaHealth: newReplicaHealth(func(ctx context.Context) error {
+			return nil
+		}, time.Hour),
+	}
+	defer store.replicaHealth.stop()
+
+	cancelled := make(chan struct{})
+	res, err := readReplicated(context.Background(), store, func(ctx context.Context, stmts *mysqlReadStmts) (string, error) {
+		if stmts == store.replica {
+			<-ctx.Done()
+			close(cancelled)
+			return "", ctx.Err()
+		}
+		return "primary", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res, "slow replica should fall back to the primary")
+	assert.False(t, store.replicaHealth.isHealthy())
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow replica query should be cancelled")
+	}
+}
+
+func TestMySQLStoreReplica(t *testing.T) {
+	db := openTestDatabase(t)
+
+	replica, err := openDatabaseConnection(testConfig.Database)
+	require.NoError(t, err)
+	defer replica.Close()
+	store, err := newMySQLStore(db, replica, ReplicaConfig{MaxLag: time.Minute, CheckInterval: time.Hour}, testConfig.UserTags.HalfLife)
+	require.NoError(t, err)
+	defer store.Close()
+	require.True(t, store.replicaHealth.isHealthy(), "a database that isn't replicating has no lag")
+
+	require.NoError(t, store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_4_YEARS"))
+	level, err := store.GetExperienceLevel(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, "MORE_THAN_4_YEARS", level)
+
+	// Reads keep working on the primary when the replica goes away
+	require.NoError(t, replica.Close())
+	level, err = store.GetExperienceLevel(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, "MORE_THAN_4_YEARS", level)
+	assert.False(t, store.replicaHealth.isHealthy())
+}
@@ -20,25 +20,63 @@ var ad = Ad{
 	Company:     "company",
 }
 
-var campaignNotAvailable = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
-	return nil, nil
+// servedAd is ad with the UTM parameters added to the links of the campaigns
+// served in the feed
+func servedAd(campaignId string) Ad {
+	res := ad
+	res.Link = "http://link.com?utm_source=daily.dev&utm_medium=native&utm_campaign=" + campaignId + "&utm_content=feed"
+	return res
 }
 
-var bsaNotAvailable = func(r *http.Request, propertyId string) (*BsaAd, error) {
-	return nil, nil
+// campaignsFunc stubs the campaigns served by the handlers
+type campaignsFunc func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error)
+
+func (f campaignsFunc) AddCampaign(ctx context.Context, camp ScheduledCampaignAd) error {
+	return nil
 }
 
-var ethicalNotAvailable = func(r *http.Request, keywords []string) (*EthicalAdsAd, error) {
+func (f campaignsFunc) FetchCampaigns(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	return f(ctx, timestamp, userId)
+}
+
+func (f campaignsFunc) FetchOverlappingCampaigns(ctx context.Context, start time.Time, end time.Time) ([]ScheduledCampaignAd, error) {
 	return nil, nil
 }
 
-var emptyUserTags = func(ctx context.Context, userId string) ([]string, error) {
-	return []string{}, nil
+// userTagsFunc stubs the tags of the users served by the handlers
+type userTagsFunc func(ctx context.Context, userId string) ([]string, error)
+
+func (f userTagsFunc) AddOrUpdateUsersTags(ctx context.Context, userTags map[string]map[string]int) error {
+	return nil
+}
+
+func (f userTagsFunc) GetUserTags(ctx context.Context, userId string) ([]string, error) {
+	return f(ctx, userId)
+}
+
+func (f userTagsFunc) DeleteOldTags(ctx context.Context, retention time.Duration) error {
+	return nil
+}
+
+// newTestStores keeps the data of the test in memory
+func newTestStores() Stores {
+	return newStores(newMemoryStore())
 }
 
-var originalGetUserTags = getUserTags
+var campaignNotAvailable = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	return nil, nil
+})
+
+var bsaNotAvailable = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
+	return nil, nil
+}
+
+var ethicalNotAvailable = func(_ *adProviders, r *http.Request, keywords []string) (*EthicalAdsAd, error) {
+	return nil, nil
+}
 
 func TestFallbackCampaignAvailable(t *testing.T) {
+	stores := newTestStores()
 	exp := []CampaignAd{
 		{
 			Ad:          ad,
@@ -52,17 +90,17 @@ func TestFallbackCampaignAvailable(t *testing.T) {
 
 	fetchEthicalAds = ethicalNotAvailable
 	fetchBsa = bsaNotAvailable
-	getUserTags = emptyUserTags
-	fetchCampaigns = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
 		return exp, nil
-	}
+	})
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -71,27 +109,28 @@ func TestFallbackCampaignAvailable(t *testing.T) {
 	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
 	assert.Equal(t, []CampaignAd{
 		{
-			Ad:          ad,
+			Ad:          servedAd("id"),
 			Placeholder: "placholder",
 			Ratio:       0.5,
 			Id:          "id",
 			Fallback:    false,
 		},
 	}, actual, "wrong body")
-	getUserTags = originalGetUserTags
 }
 
 func TestFallbackCampaignNotAvailable(t *testing.T) {
+	stores := newTestStores()
 	fetchEthicalAds = ethicalNotAvailable
 	fetchBsa = bsaNotAvailable
-	fetchCampaigns = campaignNotAvailable
+	stores.Campaigns = campaignNotAvailable
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -102,19 +141,21 @@ func TestFallbackCampaignNotAvailable(t *testing.T) {
 }
 
 func TestCampaignFail(t *testing.T) {
+	stores := newTestStores()
 	fetchEthicalAds = ethicalNotAvailable
 	fetchBsa = bsaNotAvailable
 
-	fetchCampaigns = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
 		return nil, errors.New("error")
-	}
+	})
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -125,6 +166,7 @@ func TestCampaignFail(t *testing.T) {
 }
 
 func TestCampaignAvailable(t *testing.T) {
+	stores := newTestStores()
 	exp := []CampaignAd{
 		{
 			Ad:          ad,
@@ -138,16 +180,17 @@ func TestCampaignAvailable(t *testing.T) {
 
 	fetchBsa = bsaNotAvailable
 	fetchEthicalAds = ethicalNotAvailable
-	fetchCampaigns = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
 		return exp, nil
-	}
+	})
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -156,7 +199,7 @@ func TestCampaignAvailable(t *testing.T) {
 	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
 	assert.Equal(t, []CampaignAd{
 		{
-			Ad:          ad,
+			Ad:          servedAd("id"),
 			Placeholder: "placholder",
 			Ratio:       0.5,
 			Id:          "id",
@@ -165,6 +208,7 @@ func TestCampaignAvailable(t *testing.T) {
 }
 
 func TestCampaignAvailableByGeo(t *testing.T) {
+	stores := newTestStores()
 	exp := []CampaignAd{
 		{
 			Ad:          ad,
@@ -182,16 +226,17 @@ func TestCampaignAvailableByGeo(t *testing.T) {
 	}
 	fetchBsa = bsaNotAvailable
 	fetchEthicalAds = ethicalNotAvailable
-	fetchCampaigns = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
 		return exp, nil
-	}
+	})
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -200,7 +245,7 @@ func TestCampaignAvailableByGeo(t *testing.T) {
 	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
 	assert.Equal(t, []CampaignAd{
 		{
-			Ad:          ad,
+			Ad:          servedAd("id"),
 			Placeholder: "placholder",
 			Ratio:       0.5,
 			Id:          "id",
@@ -209,6 +254,7 @@ func TestCampaignAvailableByGeo(t *testing.T) {
 }
 
 func TestBsaAvailable(t *testing.T) {
+	stores := newTestStores()
 	fetchEthicalAds = ethicalNotAvailable
 	exp := []BsaAd{
 		{
@@ -218,17 +264,18 @@ func TestBsaAvailable(t *testing.T) {
 		},
 	}
 
-	fetchCampaigns = campaignNotAvailable
-	fetchBsa = func(r *http.Request, propertyId string) (*BsaAd, error) {
+	stores.Campaigns = campaignNotAvailable
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
 		return &exp[0], nil
 	}
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -239,6 +286,7 @@ func TestBsaAvailable(t *testing.T) {
 }
 
 func TestBsaFail(t *testing.T) {
+	stores := newTestStores()
 	fetchEthicalAds = ethicalNotAvailable
 	exp := []CampaignAd{
 		{
@@ -251,20 +299,21 @@ func TestBsaFail(t *testing.T) {
 		},
 	}
 
-	fetchBsa = func(r *http.Request, propertyId string) (*BsaAd, error) {
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
 		return nil, errors.New("error")
 	}
 
-	fetchCampaigns = func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
 		return exp, nil
-	}
+	})
 
 	req, err := http.NewRequest("GET", "/a", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, stores)
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -273,10 +322,46 @@ func TestBsaFail(t *testing.T) {
 	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
 	assert.Equal(t, []CampaignAd{
 		{
-			Ad:          ad,
+			Ad:          servedAd("id"),
 			Placeholder: "placholder",
 			Ratio:       0.5,
 			Id:          "id",
 		},
 	}, actual, "wrong body")
 }
+
+func TestExperienceLevelTargeting(t *testing.T) {
+	store := newMemoryStore()
+	assert.Nil(t, store.AddOrUpdateUsersTags(context.Background(), map[string]map[string]int{"1": {"webdev": 1}}))
+	assert.Nil(t, store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_4_YEARS"))
+	stores := newStores(store)
+	stores.Campaigns = campaignNotAvailable
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	var properties []string
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
+		properties = append(properties, propertyId)
+		return nil, nil
+	}
+	var keywords []string
+	fetchEthicalAds = func(_ *adProviders, r *http.Request, k []string) (*EthicalAdsAd, error) {
+		keywords = k
+		return nil, nil
+	}
+
+	req, err := http.NewRequest("GET", "/a", nil)
+	assert.Nil(t, err)
+	setBrowserHeaders(req)
+	req.AddCookie(&http.Cookie{Name: "da2", Value: "1"})
+
+	cfg := *testConfig
+	cfg.Providers.Bsa.ExperienceProperties = map[string]string{"MORE_THAN_4_YEARS": "SENIOR"}
+	rr := httptest.NewRecorder()
+	router := createApp(&cfg, stores)
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
+	assert.Equal(t, []string{"CEBI62JM", "SENIOR", "CEBI62J7"}, properties)
+	assert.Equal(t, []string{"webdev", "senior"}, keywords)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newOpenRTBRequest(t *testing.T, bidReq OpenRTBBidRequest, token string) *http.Request {
+	body, err := json.Marshal(bidReq)
+	assert.Nil(t, err)
+	req, err := http.NewRequest("POST", "/openrtb", bytes.NewBuffer(body))
+	assert.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func inventoryApp(stores Stores, buyers map[string]string) *App {
+	cfg := *testConfig
+	cfg.Inventory = InventoryConfig{Buyers: buyers, BillingUrl: "https://ads.daily.dev/openrtb/billing"}
+	return createApp(&cfg, stores)
+}
+
+var inventoryBuyers = map[string]string{"acme": "secret"}
+
+var inventoryBidRequest = OpenRTBBidRequest{
+	Id: "auction",
+	Imp: []OpenRTBImp{
+		{Id: "1", TagId: "feed", Native: &OpenRTBNative{Request: newNativeRequest()}, BidFloor: 2},
+		{Id: "2", TagId: "unknown", Native: &OpenRTBNative{Request: newNativeRequest()}},
+	},
+	Device: &OpenRTBDevice{Ip: "8.8.8.8"},
+	User:   &OpenRTBUser{Id: "1"},
+}
+
+func TestOpenRTBInventoryAvailable(t *testing.T) {
+	stores := newTestStores()
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		assert.Equal(t, "", userId)
+		return []CampaignAd{
+			{Ad: ad, Id: "cheap", Price: 1},
+			{Ad: ad, Id: "fallback", Price: 10, Fallback: true},
+			{Ad: ad, Id: "israel", Price: 8, Geo: "israel"},
+			{Ad: ad, Id: "us", Price: 5, Geo: "united states,germany"},
+			{Ad: ad, Id: "global", Price: 3},
+		}, nil
+	})
+
+	rr := httptest.NewRecorder()
+	router := inventoryApp(stores, inventoryBuyers)
+	router.ServeHTTP(rr, newOpenRTBRequest(t, inventoryBidRequest, "secret"))
+
+	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
+
+	var actual OpenRTBBidResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
+	assert.Equal(t, "auction", actual.Id)
+	assert.Len(t, actual.SeatBid, 1)
+	assert.Len(t, actual.SeatBid[0].Bid, 1)
+	bid := actual.SeatBid[0].Bid[0]
+	assert.Equal(t, "1", bid.ImpId)
+	assert.Equal(t, "us", bid.CrId)
+	assert.Equal(t, float64(5), bid.Price)
+	assert.True(t, strings.HasPrefix(bid.BUrl, "https://ads.daily.dev/openrtb/billing?"), bid.BUrl)
+
+	native, err := parseNativeMarkup(bid.Adm)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://link.com", native.Link.Url)
+	assert.Equal(t, []NativeResponseAsset{
+		{Id: nativeAssetTitle, Title: &NativeTitleAsset{Text: "desc"}},
+		{Id: nativeAssetImage, Img: &NativeImageAsset{Url: "image", W: 1200, H: 600}},
+		{Id: nativeAssetSponsored, Data: &NativeDataAsset{Value: "company"}},
+	}, native.Assets)
+}
+
+func TestOpenRTBInventoryNotAvailable(t *testing.T) {
+	stores := newTestStores()
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		return []CampaignAd{{Ad: ad, Id: "cheap", Price: 1}}, nil
+	})
+
+	rr := httptest.NewRecorder()
+	router := inventoryApp(stores, inventoryBuyers)
+	router.ServeHTTP(rr, newOpenRTBRequest(t, inventoryBidRequest, "secret"))
+
+	assert.Equal(t, http.StatusNoContent, rr.Code, "wrong status code")
+}
+
+func TestOpenRTBInventoryBadRequest(t *testing.T) {
+	rr := httptest.NewRecorder()
+	router := inventoryApp(newTestStores(), inventoryBuyers)
+	router.ServeHTTP(rr, newOpenRTBRequest(t, OpenRTBBidRequest{Id: "auction"}, "secret"))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "wrong status code")
+}
+
+func TestOpenRTBInventoryTooLarge(t *testing.T) {
+	bidReq := inventoryBidRequest
+	bidReq.User = &OpenRTBUser{Keywords: strings.Repeat("a", maxBidRequestSize)}
+
+	rr := httptest.NewRecorder()
+	router := inventoryApp(newTestStores(), inventoryBuyers)
+	router.ServeHTTP(rr, newOpenRTBRequest(t, bidReq, "secret"))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "wrong status code")
+}
+
+func TestOpenRTBInventoryUnauthorized(t *testing.T) {
+	stores := newTestStores()
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		t.Error("campaigns fetched for an unauthorized buyer")
+		return nil, nil
+	})
+
+	cases := []struct {
+		name   string
+		buyers map[string]string
+		token  string
+	}{
+		{name: "no token", buyers: inventoryBuyers},
+		{name: "wrong token", buyers: inventoryBuyers, token: "wrong"},
+		{name: "no buyers", token: "secret"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			inventoryApp(stores, c.buyers).ServeHTTP(rr, newOpenRTBRequest(t, inventoryBidRequest, c.token))
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, "wrong status code")
+		})
+	}
+}
+
+func TestOpenRTBInventoryForgedUser(t *testing.T) {
+	stores := newTestStores()
+	getCountryByIP = func(ip string) string {
+		return "united states"
+	}
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		assert.Equal(t, "", userId)
+		return []CampaignAd{
+			{Ad: ad, Id: "tags", Price: 9, IsTagTargeted: true},
+			{Ad: ad, Id: "experience", Price: 8, IsExpTargeted: true},
+			{Ad: ad, Id: "global", Price: 3},
+		}, nil
+	})
+
+	bidReq := inventoryBidRequest
+	bidReq.User = &OpenRTBUser{Id: "victim"}
+	rr := httptest.NewRecorder()
+	inventoryApp(stores, inventoryBuyers).ServeHTTP(rr, newOpenRTBRequest(t, bidReq, "secret"))
+
+	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
+	var actual OpenRTBBidResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&actual))
+	assert.Len(t, actual.SeatBid, 1)
+	assert.Len(t, actual.SeatBid[0].Bid, 1)
+	assert.Equal(t, "global", actual.SeatBid[0].Bid[0].CrId)
+}
+
+func TestOpenRTBInventoryGdpr(t *testing.T) {
+	stores := newTestStores()
+	getCountryByIP = func(ip string) string {
+		return "germany"
+	}
+	stores.Campaigns = campaignsFunc(func(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error) {
+		return []CampaignAd{{Ad: ad, Id: "global", Price: 3}}, nil
+	})
+
+	cases := []struct {
+		name     string
+		consent  string
+		expected int
+	}{
+		{name: "no consent", expected: http.StatusNoContent},
+		{name: "invalid consent", consent: "invalid", expected: http.StatusNoContent},
+		{name: "partial consent", consent: newTcfString(1), expected: http.StatusNoContent},
+		{name: "consent", consent: newTcfString(1, 2), expected: http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bidReq := inventoryBidRequest
+			bidReq.User = &OpenRTBUser{Consent: c.consent}
+			bidReq.Regs = &OpenRTBRegs{Gdpr: 1}
+			rr := httptest.NewRecorder()
+			inventoryApp(stores, inventoryBuyers).ServeHTTP(rr, newOpenRTBRequest(t, bidReq, "secret"))
+			assert.Equal(t, c.expected, rr.Code, "wrong status code")
+		})
+	}
+}
+
+func TestOpenRTBInventoryBillingNotice(t *testing.T) {
+	billing := &inventoryBilling{url: "https://ads.daily.dev/openrtb/billing", buyers: inventoryBuyers}
+	notice := strings.ReplaceAll(billing.noticeUrl("acme", "auction-1", "global"), "${AUCTION_PRICE}", "2.5")
+	router := inventoryApp(newTestStores(), inventoryBuyers)
+
+	cases := []struct {
+		name     string
+		url      string
+		expected int
+	}{
+		{name: "valid", url: notice, expected: http.StatusNoContent},
+		{name: "forged campaign", url: strings.Replace(notice, "crid=global", "crid=other", 1), expected: http.StatusBadRequest},
+		{name: "unknown buyer", url: strings.Replace(notice, "buyer=acme", "buyer=other", 1), expected: http.StatusBadRequest},
+		{name: "missing price", url: strings.Replace(notice, "price=2.5", "price=", 1), expected: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target, err := url.Parse(c.url)
+			assert.NoError(t, err)
+			req, err := http.NewRequest("GET", target.RequestURI(), nil)
+			assert.NoError(t, err)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, c.expected, rr.Code, "wrong status code")
+		})
+	}
+}
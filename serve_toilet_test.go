@@ -19,16 +19,17 @@ func TestToiletBsaAvailable(t *testing.T) {
 		},
 	}
 
-	fetchBsa = func(r *http.Request, propertyId string) (*BsaAd, error) {
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
 		return &exp[0], nil
 	}
 
 	req, err := http.NewRequest("GET", "/a/toilet", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, newTestStores())
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -43,10 +44,11 @@ func TestToiletBsaNotAvailable(t *testing.T) {
 
 	req, err := http.NewRequest("GET", "/a/toilet", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, newTestStores())
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
@@ -57,16 +59,17 @@ func TestToiletBsaNotAvailable(t *testing.T) {
 }
 
 func TestToiletBsaNotFail(t *testing.T) {
-	fetchBsa = func(r *http.Request, propertyId string) (*BsaAd, error) {
+	fetchBsa = func(_ *adProviders, r *http.Request, propertyId string) (*BsaAd, error) {
 		return nil, errors.New("error")
 	}
 
 	req, err := http.NewRequest("GET", "/a/toilet", nil)
 	assert.Nil(t, err)
+	setBrowserHeaders(req)
 
 	rr := httptest.NewRecorder()
 
-	router := createApp()
+	router := createApp(testConfig, newTestStores())
 	router.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "wrong status code")
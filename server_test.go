@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunServerDrainsRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	assert.Nil(t, listener.Close())
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(time.Millisecond * 200)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(ctx, addr, handler, time.Second)
+	}()
+
+	responses := make(chan int, 1)
+	go func() {
+		var res *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			res, err = http.Get("http://" + addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		if err != nil {
+			responses <- 0
+			return
+		}
+		res.Body.Close()
+		responses <- res.StatusCode
+	}()
+
+	<-started
+	cancel()
+	assert.Equal(t, http.StatusOK, <-responses, "in-flight request should complete")
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// CampaignStore keeps the campaigns and selects the ones a user can be served
+type CampaignStore interface {
+	AddCampaign(ctx context.Context, camp ScheduledCampaignAd) error
+	// FetchCampaigns returns the campaigns that run at the timestamp and
+	// whose targeting matches the user
+	FetchCampaigns(ctx context.Context, timestamp time.Time, userId string) ([]CampaignAd, error)
+	// FetchOverlappingCampaigns returns the id, schedule, probability,
+	// fallback and geo of the campaigns that run at any time between start
+	// and end regardless of their targeting
+	FetchOverlappingCampaigns(ctx context.Context, start time.Time, end time.Time) ([]ScheduledCampaignAd, error)
+}
+
+// UserTagStore keeps the interest of the users in tags
+type UserTagStore interface {
+	// AddOrUpdateUsersTags adds the number of reads of every tag per user
+	AddOrUpdateUsersTags(ctx context.Context, userTags map[string]map[string]int) error
+	// GetUserTags returns the top tags of the user ranked by interest
+	GetUserTags(ctx context.Context, userId string) ([]string, error)
+	// DeleteOldTags deletes the tags that weren't read for longer than retention
+	DeleteOldTags(ctx context.Context, retention time.Duration) error
+}
+
+// ExperienceLevelStore keeps the experience level of the users
+type ExperienceLevelStore interface {
+	SetExperienceLevel(ctx context.Context, userId string, experienceLevel string) error
+	DeleteExperienceLevel(ctx context.Context, userId string) error
+	// GetExperienceLevel returns UNKNOWN for users without a level
+	GetExperienceLevel(ctx context.Context, userId string) (string, error)
+}
+
+// PrivacyStore erases and exports the personal data of the users
+type PrivacyStore interface {
+	// EraseUser deletes all the personal data of the user
+	EraseUser(ctx context.Context, userId string) error
+	// ExportUserData returns all the personal data of the user, users without
+	// data get an export with no tags
+	ExportUserData(ctx context.Context, userId string) (*UserDataExport, error)
+}
+
+// Stores are the data stores injected into the app and the workers
+type Stores struct {
+	Campaigns        CampaignStore
+	UserTags         UserTagStore
+	ExperienceLevels ExperienceLevelStore
+	Privacy          PrivacyStore
+}
+
+// newStores uses a single backend, like mysqlStore or memoryStore, for all
+// the stores
+func newStores(store interface {
+	CampaignStore
+	UserTagStore
+	ExperienceLevelStore
+	PrivacyStore
+}) Stores {
+	return Stores{
+		Campaigns:        store,
+		UserTags:         store,
+		ExperienceLevels: store,
+		Privacy:          store,
+	}
+}
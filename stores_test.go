@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestDatabase migrates the test database and drops it when the test ends
+func openTestDatabase(t *testing.T) *sql.DB {
+	migrateDatabase(testConfig.Database)
+	db, _ := initializeDatabase(testConfig.Database)
+	t.Cleanup(func() {
+		dropDatabase(testConfig.Database)
+		tearDatabase(db, nil)
+	})
+	return db
+}
+
+// newMySQLTestStore prepares the store on the test database
+func newMySQLTestStore(t *testing.T, db *sql.DB) *mysqlStore {
+	store, err := newMySQLStore(db, nil, testConfig.Database.Replica, testConfig.UserTags.HalfLife)
+	require.NoError(t, err)
+	t.Cleanup(store.Close)
+	return store
+}
+
+func addOrUpdateUserTags(ctx context.Context, store UserTagStore, userId string, tags []string) error {
+	reads := make(map[string]int, len(tags))
+	for _, tag := range tags {
+		reads[tag]++
+	}
+	return store.AddOrUpdateUsersTags(ctx, map[string]map[string]int{userId: reads})
+}
+
+func scheduledCampaign(id string) ScheduledCampaignAd {
+	return ScheduledCampaignAd{
+		CampaignAd: CampaignAd{
+			Ad:          ad,
+			Id:          id,
+			Placeholder: "placeholder",
+			Ratio:       0.5,
+			Probability: 1,
+		},
+		Start: time.Now().Add(time.Hour * -1),
+		End:   time.Now().Add(time.Hour),
+	}
+}
+
+func campaignIds(camps []CampaignAd) []string {
+	var ids []string
+	for _, camp := range camps {
+		ids = append(ids, camp.Id)
+	}
+	return ids
+}
+
+func scheduledCampaignAds(camps []ScheduledCampaignAd) []CampaignAd {
+	var res []CampaignAd
+	for _, camp := range camps {
+		res = append(res, camp.CampaignAd)
+	}
+	return res
+}
+
+// testStoreContract is the behavior every implementation of the stores must
+// have, newStores returns empty stores
+func testStoreContract(t *testing.T, newStores func(t *testing.T) Stores) {
+	ctx := context.Background()
+
+	t.Run("AddAndFetchCampaigns", func(t *testing.T) {
+		stores := newStores(t)
+		fallback := scheduledCampaign("fallback")
+		fallback.Fallback = true
+		fallback.Image = "https://res.cloudinary.com/daily-now/image.png"
+		geo := scheduledCampaign("geo")
+		geo.Geo = "united states"
+		geo.Utm = UtmTemplate{Source: "newsletter", Content: "{placement}"}
+		expired := scheduledCampaign("expired")
+		expired.End = time.Now().Add(time.Hour * -1)
+		scheduled := scheduledCampaign("scheduled")
+		scheduled.Start = time.Now().Add(time.Hour)
+		for _, camp := range []ScheduledCampaignAd{fallback, geo, expired, scheduled} {
+			require.NoError(t, stores.Campaigns.AddCampaign(ctx, camp))
+		}
+		assert.Error(t, stores.Campaigns.AddCampaign(ctx, geo), "campaign ids are unique")
+
+		res, err := stores.Campaigns.FetchCampaigns(ctx, time.Now(), "1")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"fallback", "geo"}, campaignIds(res))
+		for _, camp := range res {
+			switch camp.Id {
+			case "fallback":
+				assert.Equal(t, "https://res.cloudinary.com/daily-now/image.png", camp.Image, "images are rewritten when served")
+				assert.Equal(t, "", camp.ProviderId)
+			case "geo":
+				assert.Equal(t, "united states", camp.Geo)
+				assert.Equal(t, geo.Utm, camp.utm)
+				assert.Equal(t, "direct-geo", camp.ProviderId)
+			}
+		}
+	})
+
+	t.Run("FetchOverlappingCampaigns", func(t *testing.T) {
+		stores := newStores(t)
+		now := time.Now().Truncate(time.Second)
+		current := scheduledCampaign("current")
+		current.Geo = "germany"
+		current.Probability = 0.4
+		current.Start, current.End = now.Add(-time.Hour), now.Add(time.Hour)
+		upcoming := scheduledCampaign("upcoming")
+		upcoming.Start, upcoming.End = now.Add(time.Hour*2), now.Add(time.Hour*3)
+		for _, camp := range []ScheduledCampaignAd{current, upcoming} {
+			require.NoError(t, stores.Campaigns.AddCampaign(ctx, camp))
+		}
+
+		res, err := stores.Campaigns.FetchOverlappingCampaigns(ctx, now, now.Add(time.Hour*2))
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		assert.Equal(t, "current", res[0].Id)
+		assert.Equal(t, "germany", res[0].Geo)
+		assert.Equal(t, float32(0.4), res[0].Probability)
+		assert.True(t, current.Start.Equal(res[0].Start))
+		assert.True(t, current.End.Equal(res[0].End))
+
+		res, err = stores.Campaigns.FetchOverlappingCampaigns(ctx, now.Add(-time.Hour*2), now.Add(time.Hour*4))
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"current", "upcoming"}, campaignIds(scheduledCampaignAds(res)))
+	})
+
+	t.Run("FetchCampaignsByTargeting", func(t *testing.T) {
+		stores := newStores(t)
+		tags := scheduledCampaign("tags")
+		tags.Tags = []string{"javascript", "webdev"}
+		levels := scheduledCampaign("levels")
+		levels.ExperienceLevels = []string{"MORE_THAN_4_YEARS", "NOT_ENGINEER"}
+		expRange := scheduledCampaign("range")
+		expRange.MinExperienceLevel = "MORE_THAN_2_YEARS"
+		expRange.MaxExperienceLevel = "MORE_THAN_6_YEARS"
+		openRange := scheduledCampaign("open")
+		openRange.MaxExperienceLevel = "MORE_THAN_1_YEAR"
+		both := scheduledCampaign("both")
+		both.Tags = []string{"php"}
+		both.ExperienceLevels = []string{"MORE_THAN_4_YEARS"}
+		for _, camp := range []ScheduledCampaignAd{tags, levels, expRange, openRange, both, scheduledCampaign("untargeted")} {
+			require.NoError(t, stores.Campaigns.AddCampaign(ctx, camp))
+		}
+
+		require.NoError(t, addOrUpdateUserTags(ctx, stores.UserTags, "1", []string{"javascript"}))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "1", "MORE_THAN_4_YEARS"))
+		require.NoError(t, addOrUpdateUserTags(ctx, stores.UserTags, "2", []string{"php"}))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "2", "MORE_THAN_4_YEARS"))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "3", "NOT_ENGINEER"))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "4", "LESS_THAN_1_YEAR"))
+
+		expected := map[string][]string{
+			"1": {"tags", "levels", "range", "untargeted"},
+			"2": {"levels", "range", "both", "untargeted"},
+			"3": {"levels", "untargeted"},
+			"4": {"open", "untargeted"},
+			"5": {"untargeted"},
+			"":  {"untargeted"},
+		}
+		for userId, ids := range expected {
+			res, err := stores.Campaigns.FetchCampaigns(ctx, time.Now(), userId)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, ids, campaignIds(res), "user %q", userId)
+			for _, camp := range res {
+				assert.Equal(t, camp.Id == "tags" || camp.Id == "both", camp.IsTagTargeted, camp.Id)
+				assert.Equal(t, camp.Id != "tags" && camp.Id != "untargeted", camp.IsExpTargeted, camp.Id)
+				if camp.Id == "untargeted" {
+					assert.Equal(t, "direct", camp.ProviderId)
+				} else {
+					assert.Equal(t, "direct-keywords", camp.ProviderId, camp.Id)
+				}
+			}
+		}
+	})
+
+	t.Run("UserTags", func(t *testing.T) {
+		stores := newStores(t)
+		require.NoError(t, stores.UserTags.AddOrUpdateUsersTags(ctx, map[string]map[string]int{
+			"1": {"go": 1, "rust": 2},
+			"2": {"webdev": 1},
+		}))
+		require.NoError(t, addOrUpdateUserTags(ctx, stores.UserTags, "1", []string{"go", "go", "python"}))
+
+		tags, err := stores.UserTags.GetUserTags(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"go", "rust", "python"}, tags)
+
+		tags, err = stores.UserTags.GetUserTags(ctx, "2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"webdev"}, tags)
+
+		tags, err = stores.UserTags.GetUserTags(ctx, "3")
+		require.NoError(t, err)
+		assert.Empty(t, tags)
+
+		require.NoError(t, stores.UserTags.DeleteOldTags(ctx, time.Hour))
+		tags, err = stores.UserTags.GetUserTags(ctx, "1")
+		require.NoError(t, err)
+		assert.Len(t, tags, 3, "recent tags should be kept")
+	})
+
+	t.Run("UserTagsLimit", func(t *testing.T) {
+		stores := newStores(t)
+		reads := make(map[string]int)
+		for i := 0; i < 60; i++ {
+			reads[fmt.Sprintf("tag%d", i)] = i + 1
+		}
+		require.NoError(t, stores.UserTags.AddOrUpdateUsersTags(ctx, map[string]map[string]int{"1": reads}))
+
+		tags, err := stores.UserTags.GetUserTags(ctx, "1")
+		require.NoError(t, err)
+		assert.Len(t, tags, 50)
+		assert.Equal(t, "tag59", tags[0])
+	})
+
+	t.Run("ExperienceLevels", func(t *testing.T) {
+		stores := newStores(t)
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "1", "MORE_THAN_2_YEARS"))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "1", "MORE_THAN_6_YEARS"))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "2", "NOT_ENGINEER"))
+
+		level, err := stores.ExperienceLevels.GetExperienceLevel(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "MORE_THAN_6_YEARS", level)
+
+		require.NoError(t, stores.ExperienceLevels.DeleteExperienceLevel(ctx, "1"))
+		level, err = stores.ExperienceLevels.GetExperienceLevel(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "UNKNOWN", level)
+
+		level, err = stores.ExperienceLevels.GetExperienceLevel(ctx, "2")
+		require.NoError(t, err)
+		assert.Equal(t, "NOT_ENGINEER", level)
+	})
+
+	t.Run("EraseAndExportUserData", func(t *testing.T) {
+		stores := newStores(t)
+		require.NoError(t, stores.UserTags.AddOrUpdateUsersTags(ctx, map[string]map[string]int{
+			"1": {"go": 2, "rust": 1},
+			"2": {"webdev": 1},
+		}))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "1", "MORE_THAN_4_YEARS"))
+		require.NoError(t, stores.ExperienceLevels.SetExperienceLevel(ctx, "2", "NOT_ENGINEER"))
+
+		data, err := stores.Privacy.ExportUserData(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "1", data.UserId)
+		require.Len(t, data.Tags, 2)
+		for i, expected := range []UserTagExport{{Tag: "go", ReadCount: 2, Score: 2}, {Tag: "rust", ReadCount: 1, Score: 1}} {
+			assert.NotEmpty(t, data.Tags[i].LastRead)
+			data.Tags[i].LastRead = ""
+			assert.Equal(t, expected, data.Tags[i])
+		}
+		require.NotNil(t, data.ExperienceLevel)
+		assert.Equal(t, "MORE_THAN_4_YEARS", data.ExperienceLevel.ExperienceLevel)
+		assert.NotEmpty(t, data.ExperienceLevel.UpdatedAt)
+
+		require.NoError(t, stores.Privacy.EraseUser(ctx, "1"))
+		data, err = stores.Privacy.ExportUserData(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, &UserDataExport{UserId: "1", Tags: []UserTagExport{}}, data)
+		level, err := stores.ExperienceLevels.GetExperienceLevel(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "UNKNOWN", level)
+
+		tags, err := stores.UserTags.GetUserTags(ctx, "2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"webdev"}, tags, "other users should be kept")
+		level, err = stores.ExperienceLevels.GetExperienceLevel(ctx, "2")
+		require.NoError(t, err)
+		assert.Equal(t, "NOT_ENGINEER", level)
+	})
+}
+
+func TestMemoryStoreContract(t *testing.T) {
+	testStoreContract(t, func(t *testing.T) Stores {
+		return newStores(newMemoryStore())
+	})
+}
+
+func TestMySQLStoreContract(t *testing.T) {
+	testStoreContract(t, func(t *testing.T) Stores {
+		return newStores(newMySQLTestStore(t, openTestDatabase(t)))
+	})
+}
+
+func TestMemoryStoreDeleteOldTags(t *testing.T) {
+	store := newMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time {
+		return now
+	}
+	require.NoError(t, addOrUpdateUserTags(context.Background(), store, "1", []string{"webdev"}))
+
+	now = now.Add(time.Hour * 24 * 200)
+	require.NoError(t, addOrUpdateUserTags(context.Background(), store, "1", []string{"php"}))
+	require.NoError(t, store.DeleteOldTags(context.Background(), testConfig.UserTags.Retention))
+
+	tags, err := store.GetUserTags(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"php"}, tags)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tagBatcher coalesces the tags of view messages per user, counting the reads
+// of every tag, and writes them in a single upsert once the batch is full or
+// the window has passed. Callers are blocked until their batch is committed,
+// so messages are acked only after their tags were written.
+type tagBatcher struct {
+	mutex   sync.Mutex
+	maxSize int
+	window  time.Duration
+	write   func(ctx context.Context, userTags map[string]map[string]int) error
+
+	pending map[string]map[string]int
+	size    int
+	waiters []chan error
+	timer   *time.Timer
+}
+
+type tagBatch struct {
+	userTags map[string]map[string]int
+	waiters  []chan error
+}
+
+func newTagBatcher(maxSize int, window time.Duration, write func(ctx context.Context, userTags map[string]map[string]int) error) *tagBatcher {
+	return &tagBatcher{
+		maxSize: maxSize,
+		window:  window,
+		write:   write,
+		pending: make(map[string]map[string]int),
+	}
+}
+
+// add queues the tags and waits for the batch that contains them to commit
+func (b *tagBatcher) add(userId string, tags []string) error {
+	done := make(chan error, 1)
+
+	b.mutex.Lock()
+	userTags, ok := b.pending[userId]
+	if !ok {
+		userTags = make(map[string]int)
+		b.pending[userId] = userTags
+	}
+	for _, tag := range tags {
+		if _, exists := userTags[tag]; !exists {
+			b.size++
+		}
+		userTags[tag]++
+	}
+	b.waiters = append(b.waiters, done)
+
+	if b.size >= b.maxSize {
+		batch := b.take()
+		b.mutex.Unlock()
+		go b.commit(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, b.flush)
+		}
+		b.mutex.Unlock()
+	}
+
+	return <-done
+}
+
+// take empties the pending batch, must be called with the mutex held
+func (b *tagBatcher) take() tagBatch {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	batch := tagBatch{userTags: b.pending, waiters: b.waiters}
+	b.pending = make(map[string]map[string]int)
+	b.size = 0
+	b.waiters = nil
+	return batch
+}
+
+func (b *tagBatcher) flush() {
+	b.mutex.Lock()
+	batch := b.take()
+	b.mutex.Unlock()
+	b.commit(batch)
+}
+
+func (b *tagBatcher) commit(batch tagBatch) {
+	if len(batch.waiters) == 0 {
+		return
+	}
+
+	var err error
+	if len(batch.userTags) > 0 {
+		err = b.write(context.Background(), batch.userTags)
+	}
+	for _, done := range batch.waiters {
+		done <- err
+	}
+}
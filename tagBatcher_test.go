@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordedWrites struct {
+	mutex  sync.Mutex
+	writes []map[string]map[string]int
+}
+
+func (r *recordedWrites) write(ctx context.Context, userTags map[string]map[string]int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writes = append(r.writes, userTags)
+	return nil
+}
+
+func TestTagBatcherCoalescesPerUser(t *testing.T) {
+	var recorded recordedWrites
+	batcher := newTagBatcher(100, time.Millisecond*50, recorded.write)
+
+	var wg sync.WaitGroup
+	for _, view := range []ViewMessage{
+		{UserId: "1", Tags: []string{"go", "rust"}},
+		{UserId: "1", Tags: []string{"go", "webdev"}},
+		{UserId: "2", Tags: []string{"go"}},
+	} {
+		wg.Add(1)
+		go func(view ViewMessage) {
+			defer wg.Done()
+			assert.Nil(t, batcher.add(view.UserId, view.Tags))
+		}(view)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []map[string]map[string]int{
+		{"1": {"go": 2, "rust": 1, "webdev": 1}, "2": {"go": 1}},
+	}, recorded.writes)
+}
+
+func TestTagBatcherFlushesFullBatch(t *testing.T) {
+	var recorded recordedWrites
+	batcher := newTagBatcher(2, time.Hour, recorded.write)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- batcher.add("1", []string{"go"})
+	}()
+	assert.Nil(t, batcher.add("2", []string{"go"}))
+	assert.Nil(t, <-done)
+	assert.Len(t, recorded.writes, 1)
+}
+
+func TestTagBatcherFail(t *testing.T) {
+	batcher := newTagBatcher(100, time.Millisecond*10, func(ctx context.Context, userTags map[string]map[string]int) error {
+		return errors.New("error")
+	})
+
+	assert.Error(t, batcher.add("1", []string{"go"}))
+}
@@ -4,15 +4,78 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
 
 	"github.com/afex/hystrix-go/hystrix"
 )
 
-func setOrUpdateExperienceLevel(ctx context.Context, userId string, experienceLevel string) error {
+// experienceLevels is the ordered scale of engineering experience, from the
+// least to the most experienced. NOT_ENGINEER is not part of the scale.
+var experienceLevels = []string{
+	"LESS_THAN_1_YEAR",
+	"MORE_THAN_1_YEAR",
+	"MORE_THAN_2_YEARS",
+	"MORE_THAN_4_YEARS",
+	"MORE_THAN_6_YEARS",
+	"MORE_THAN_10_YEARS",
+}
+
+const notEngineer = "NOT_ENGINEER"
+
+var errInvalidExperienceRange = errors.New("invalid experience level range")
+
+// experienceLevelRank is the position of the level on the scale starting
+// from 1, or 0 when the level is not on the scale
+func experienceLevelRank(level string) int {
+	for i, l := range experienceLevels {
+		if l == level {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func isValidExperienceLevel(level string) bool {
+	return level == notEngineer || experienceLevelRank(level) > 0
+}
+
+// validateExperienceRange checks that the bounds of a campaign's range are on
+// the scale and ordered, empty bounds leave the range open
+func validateExperienceRange(min string, max string) error {
+	if min != "" && experienceLevelRank(min) == 0 {
+		return errInvalidExperienceRange
+	}
+	if max != "" && experienceLevelRank(max) == 0 {
+		return errInvalidExperienceRange
+	}
+	if min != "" && max != "" && experienceLevelRank(min) > experienceLevelRank(max) {
+		return errInvalidExperienceRange
+	}
+	return nil
+}
+
+// experienceScaleSql lists the scale as arguments of the sql field function
+// which returns the rank of a level or 0 when it's not on the scale
+func experienceScaleSql() string {
+	return "'" + strings.Join(experienceLevels, "', '") + "'"
+}
+
+// experienceSeniority groups the experience levels into the seniorities that
+// third-party demand can target
+var experienceSeniority = map[string]string{
+	"LESS_THAN_1_YEAR":   "junior",
+	"MORE_THAN_1_YEAR":   "junior",
+	"MORE_THAN_2_YEARS":  "mid-level",
+	"MORE_THAN_4_YEARS":  "senior",
+	"MORE_THAN_6_YEARS":  "senior",
+	"MORE_THAN_10_YEARS": "senior",
+}
+
+func (s *mysqlStore) SetExperienceLevel(ctx context.Context, userId string, experienceLevel string) error {
 	return hystrix.DoC(ctx, hystrixDb,
 		func(ctx context.Context) error {
 			var query = "INSERT INTO user_experience_levels (user_id, experience_level) VALUES (?, ?) ON DUPLICATE KEY UPDATE experience_level=?, d_update=CURRENT_TIMESTAMP"
-			_, err := db.ExecContext(ctx, query, userId, experienceLevel, experienceLevel)
+			_, err := s.db.ExecContext(ctx, query, userId, experienceLevel, experienceLevel)
 			if err != nil {
 				return err
 			}
@@ -20,10 +83,10 @@ func setOrUpdateExperienceLevel(ctx context.Context, userId string, experienceLe
 		}, nil)
 }
 
-func deleteUserExperienceLevel(ctx context.Context, userId string) error {
+func (s *mysqlStore) DeleteExperienceLevel(ctx context.Context, userId string) error {
 	return hystrix.DoC(ctx, hystrixDb,
 		func(ctx context.Context) error {
-			_, err := db.ExecContext(ctx, "DELETE FROM user_experience_levels WHERE user_id = ?", userId)
+			_, err := s.db.ExecContext(ctx, "DELETE FROM user_experience_levels WHERE user_id = ?", userId)
 			if err != nil {
 				return err
 			}
@@ -31,28 +94,21 @@ func deleteUserExperienceLevel(ctx context.Context, userId string) error {
 		}, nil)
 }
 
-var getUserExperienceLevel = func(ctx context.Context, userId string) (string, error) {
-	output := make(chan string, 1)
-	errors := hystrix.GoC(ctx, hystrixDb,
-		func(ctx context.Context) error {
-
-			var experienceLevel string
-			row := getUserExperienceLevelStmt.QueryRow(userId)
-			switch err := row.Scan(&experienceLevel); {
-			case errors.Is(err, sql.ErrNoRows):
-				output <- "UNKNOWN"
-				return nil
-			case err == nil:
-				output <- experienceLevel
-				return nil
-			default:
-				return err
-			}
-		}, nil)
-	select {
-	case out := <-output:
-		return out, nil
-	case err := <-errors:
+func (s *mysqlStore) GetExperienceLevel(ctx context.Context, userId string) (string, error) {
+	experienceLevel, err := readReplicated(ctx, s, func(ctx context.Context, stmts *mysqlReadStmts) (string, error) {
+		var experienceLevel string
+		row := stmts.getExperienceLevel.QueryRowContext(ctx, userId)
+		switch err := row.Scan(&experienceLevel); {
+		case errors.Is(err, sql.ErrNoRows):
+			return "UNKNOWN", nil
+		case err == nil:
+			return experienceLevel, nil
+		default:
+			return "", err
+		}
+	})
+	if err != nil {
 		return "UNKNOWN", err
 	}
+	return experienceLevel, nil
 }
@@ -4,18 +4,17 @@ import (
 	"context"
 	"testing"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSetOrUpdateUserExperienceLevel(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 	_, err := db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('1', 'MORE_THAN_2_YEARS')")
 	require.NoError(t, err)
 
-	err = setOrUpdateExperienceLevel(context.Background(), "1", "MORE_THAN_6_YEARS")
+	err = store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_6_YEARS")
 	require.NoError(t, err)
 
 	row := db.QueryRow("SELECT user_id, experience_level FROM user_experience_levels")
@@ -29,17 +28,15 @@ func TestSetOrUpdateUserExperienceLevel(t *testing.T) {
 }
 
 func TestDeleteUserExperienceLevel(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 	_, err := db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('1', 'MORE_THAN_4_YEARS'), ('2', 'MORE_THAN_10_YEARS')")
 	require.NoError(t, err)
 
-	err = setOrUpdateExperienceLevel(context.Background(), "1", "MORE_THAN_10_YEARS")
+	err = store.SetExperienceLevel(context.Background(), "1", "MORE_THAN_10_YEARS")
 	require.NoError(t, err)
 
-	err = deleteUserExperienceLevel(context.Background(), "1")
+	err = store.DeleteExperienceLevel(context.Background(), "1")
 	require.NoError(t, err)
 
 	row := db.QueryRow("SELECT count(*) FROM user_experience_levels")
@@ -50,28 +47,78 @@ func TestDeleteUserExperienceLevel(t *testing.T) {
 }
 
 func TestGetUserExperienceLevel(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 	_, err := db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('1', 'MORE_THAN_4_YEARS'), ('2', 'MORE_THAN_10_YEARS')")
 	require.NoError(t, err)
 
 	{
-		level, err := getUserExperienceLevel(context.Background(), "1")
+		level, err := store.GetExperienceLevel(context.Background(), "1")
 		require.NoError(t, err)
 		require.Equal(t, "MORE_THAN_4_YEARS", level)
 	}
 
 	{
-		level, err := getUserExperienceLevel(context.Background(), "2")
+		level, err := store.GetExperienceLevel(context.Background(), "2")
 		require.NoError(t, err)
 		require.Equal(t, "MORE_THAN_10_YEARS", level)
 	}
 
 	{
-		level, err := getUserExperienceLevel(context.Background(), "3")
+		level, err := store.GetExperienceLevel(context.Background(), "3")
 		require.NoError(t, err)
 		require.Equal(t, "UNKNOWN", level)
 	}
 }
+
+func TestExperienceLevelRank(t *testing.T) {
+	require.Less(t, experienceLevelRank("LESS_THAN_1_YEAR"), experienceLevelRank("MORE_THAN_1_YEAR"))
+	require.Less(t, experienceLevelRank("MORE_THAN_6_YEARS"), experienceLevelRank("MORE_THAN_10_YEARS"))
+	require.Equal(t, 0, experienceLevelRank("NOT_ENGINEER"))
+	require.Equal(t, 0, experienceLevelRank("UNKNOWN"))
+	require.True(t, isValidExperienceLevel("NOT_ENGINEER"))
+	require.False(t, isValidExperienceLevel(""))
+}
+
+func TestValidateExperienceRange(t *testing.T) {
+	require.NoError(t, validateExperienceRange("", ""))
+	require.NoError(t, validateExperienceRange("MORE_THAN_4_YEARS", ""))
+	require.NoError(t, validateExperienceRange("", "MORE_THAN_4_YEARS"))
+	require.NoError(t, validateExperienceRange("MORE_THAN_4_YEARS", "MORE_THAN_4_YEARS"))
+	require.ErrorIs(t, validateExperienceRange("MORE_THAN_10_YEARS", "MORE_THAN_4_YEARS"), errInvalidExperienceRange)
+	require.ErrorIs(t, validateExperienceRange("NOT_ENGINEER", ""), errInvalidExperienceRange)
+	require.ErrorIs(t, validateExperienceRange("", "SENIOR"), errInvalidExperienceRange)
+}
+
+func TestNewAdInvalidExperienceRange(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	workers := &Workers{stores: newStores(store)}
+	camp := validCampaign("1")
+	camp.MinExperienceLevel = "MORE_THAN_10_YEARS"
+	camp.MaxExperienceLevel = "MORE_THAN_4_YEARS"
+
+	// An invalid range never becomes valid, so the message must not be retried
+	err := workers.NewAd(ctx, log.NewEntry(log.StandardLogger()), camp)
+	var rejection *rejectionError
+	require.ErrorAs(t, err, &rejection)
+	require.Equal(t, "experienceRange", rejection.Reasons[0].Field)
+	res, err := store.FetchOverlappingCampaigns(ctx, camp.Start, camp.End)
+	require.NoError(t, err)
+	require.Empty(t, res, "campaign with an invalid range should not be added")
+}
+
+func TestUpdateUserExperienceLevelCleared(t *testing.T) {
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+	_, err := db.Exec("INSERT INTO user_experience_levels (user_id, experience_level) VALUES ('1', 'MORE_THAN_4_YEARS')")
+	require.NoError(t, err)
+
+	workers := &Workers{stores: newStores(store)}
+	err = workers.UpdateUserExperienceLevel(context.Background(), log.NewEntry(log.StandardLogger()), UserUpdatedMessage{NewProfile: user{Id: "1"}})
+	require.NoError(t, err)
+
+	level, err := store.GetExperienceLevel(context.Background(), "1")
+	require.NoError(t, err)
+	require.Equal(t, "UNKNOWN", level)
+}
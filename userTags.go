@@ -2,23 +2,55 @@ package main
 
 import (
 	"context"
+	"math"
+	"sort"
+	"time"
+
 	"github.com/afex/hystrix-go/hystrix"
 )
 
-func addOrUpdateUserTags(ctx context.Context, userId string, tags []string) error {
+// userTagDecay is the decay constant per second of the interest score, so
+// interest in a tag halves every halfLife without reads
+func userTagDecay(halfLife time.Duration) float64 {
+	return math.Ln2 / halfLife.Seconds()
+}
+
+// AddOrUpdateUsersTags upserts the tags of multiple users in a single query.
+// The interest score of existing tags decays since their last read before
+// adding the new reads.
+func (s *mysqlStore) AddOrUpdateUsersTags(ctx context.Context, userTags map[string]map[string]int) error {
+	// Sort the rows to always lock them in the same order
+	userIds := make([]string, 0, len(userTags))
+	for userId := range userTags {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+
 	return hystrix.DoC(ctx, hystrixDb,
 		func(ctx context.Context) error {
 			var parameters []interface{}
-			var query = "INSERT INTO user_tags (user_id, tag) VALUES "
-			for i, tag := range tags {
-				if i > 0 {
-					query += ", "
+			var query = "INSERT INTO user_tags (user_id, tag, read_count, score) VALUES "
+			for _, userId := range userIds {
+				tags := make([]string, 0, len(userTags[userId]))
+				for tag := range userTags[userId] {
+					tags = append(tags, tag)
+				}
+				sort.Strings(tags)
+				for _, tag := range tags {
+					if len(parameters) > 0 {
+						query += ", "
+					}
+					query += "(?,?,?,?)"
+					reads := userTags[userId][tag]
+					parameters = append(parameters, userId, tag, reads, reads)
 				}
-				query += "(?,?)"
-				parameters = append(parameters, userId, tag)
 			}
-			query += "ON DUPLICATE KEY UPDATE last_read=CURRENT_TIMESTAMP"
-			_, err := db.ExecContext(ctx, query, parameters...)
+			query += " ON DUPLICATE KEY UPDATE " +
+				"score=score*exp(-?*timestampdiff(second, last_read, CURRENT_TIMESTAMP))+values(read_count), " +
+				"read_count=read_count+values(read_count), " +
+				"last_read=CURRENT_TIMESTAMP"
+			parameters = append(parameters, s.tagDecay)
+			_, err := s.db.ExecContext(ctx, query, parameters...)
 			if err != nil {
 				return err
 			}
@@ -26,10 +58,10 @@ func addOrUpdateUserTags(ctx context.Context, userId string, tags []string) erro
 		}, nil)
 }
 
-func deleteOldTags(ctx context.Context) error {
+func (s *mysqlStore) DeleteOldTags(ctx context.Context, retention time.Duration) error {
 	return hystrix.DoC(ctx, hystrixDb,
 		func(ctx context.Context) error {
-			_, err := db.ExecContext(ctx, "DELETE FROM user_tags WHERE last_read < now() - interval 6 month")
+			_, err := s.db.ExecContext(ctx, "DELETE FROM user_tags WHERE last_read < now() - interval ? second", int64(retention.Seconds()))
 			if err != nil {
 				return err
 			}
@@ -37,37 +69,27 @@ func deleteOldTags(ctx context.Context) error {
 		}, nil)
 }
 
-var getUserTags = func(ctx context.Context, userId string) ([]string, error) {
-	output := make(chan []string, 1)
-	errors := hystrix.GoC(ctx, hystrixDb,
-		func(ctx context.Context) error {
-			rows, err := getUserTagsStmt.QueryContext(ctx, userId)
-			if err != nil {
-				return err
-			}
-			defer rows.Close()
+func (s *mysqlStore) GetUserTags(ctx context.Context, userId string) ([]string, error) {
+	return readReplicated(ctx, s, func(ctx context.Context, stmts *mysqlReadStmts) ([]string, error) {
+		rows, err := stmts.getUserTags.QueryContext(ctx, userId, s.tagDecay)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
 
-			var res []string
-			var tag string
-			for rows.Next() {
-				err = rows.Scan(&tag)
-				if err != nil {
-					return err
-				}
-				res = append(res, tag)
-			}
-			err = rows.Err()
+		var res []string
+		var tag string
+		for rows.Next() {
+			err = rows.Scan(&tag)
 			if err != nil {
-				return err
+				return nil, err
 			}
-
-			output <- res
-			return nil
-		}, nil)
-	select {
-	case out := <-output:
-		return out, nil
-	case err := <-errors:
-		return nil, err
-	}
+			res = append(res, tag)
+		}
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
 }
@@ -8,10 +8,8 @@ import (
 )
 
 func TestAddOrUpdateUserTags(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 	_, err := db.Exec("INSERT INTO user_tags (user_id, tag, last_read) VALUES ('1', 'webdev', '2021-09-12 08:54:07')")
 	assert.Nil(t, err)
 
@@ -23,7 +21,7 @@ func TestAddOrUpdateUserTags(t *testing.T) {
 	err = rows.Scan(&webdevLastRead)
 	assert.Nil(t, err)
 
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"webdev", "javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"webdev", "javascript"})
 	assert.Nil(t, err)
 
 	rows, err = db.Query("SELECT user_id, tag, last_read FROM user_tags ORDER BY tag")
@@ -52,17 +50,15 @@ func TestAddOrUpdateUserTags(t *testing.T) {
 }
 
 func TestDeleteOldUserTags(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 	_, err := db.Exec("INSERT INTO user_tags (user_id, tag, last_read) VALUES ('1', 'webdev', '2021-01-12 08:54:07')")
 	assert.Nil(t, err)
 
-	err = addOrUpdateUserTags(context.Background(), "1", []string{"php", "javascript"})
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"php", "javascript"})
 	assert.Nil(t, err)
 
-	err = deleteOldTags(context.Background())
+	err = store.DeleteOldTags(context.Background(), testConfig.UserTags.Retention)
 	assert.Nil(t, err)
 
 	rows, err := db.Query("SELECT count(*) FROM user_tags")
@@ -75,15 +71,67 @@ func TestDeleteOldUserTags(t *testing.T) {
 }
 
 func TestGetUserTags(t *testing.T) {
-	migrateDatabase()
-	initializeDatabase()
-	defer tearDatabase()
-	defer dropDatabase()
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
 	_, err := db.Exec("INSERT INTO user_tags (user_id, tag, last_read) VALUES ('1', 'webdev', '2021-01-12 08:54:07'), ('1', 'php', '2021-01-12 08:54:07'), ('2', 'webdev', '2021-01-12 08:54:07')")
 	assert.Nil(t, err)
 
-	tags, err := getUserTags(context.Background(), "1")
+	tags, err := store.GetUserTags(context.Background(), "1")
 	assert.Nil(t, err)
 	sort.Strings(tags)
 	assert.Equal(t, []string{"php", "webdev"}, tags)
 }
+
+func TestAddOrUpdateUsersTags(t *testing.T) {
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	err := store.AddOrUpdateUsersTags(context.Background(), map[string]map[string]int{
+		"1": {"webdev": 1, "javascript": 2},
+		"2": {"webdev": 1},
+	})
+	assert.Nil(t, err)
+
+	tags, err := store.GetUserTags(context.Background(), "1")
+	assert.Nil(t, err)
+	sort.Strings(tags)
+	assert.Equal(t, []string{"javascript", "webdev"}, tags)
+
+	tags, err = store.GetUserTags(context.Background(), "2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"webdev"}, tags)
+}
+
+func TestUserTagScore(t *testing.T) {
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	err := addOrUpdateUserTags(context.Background(), store, "1", []string{"webdev", "webdev"})
+	assert.Nil(t, err)
+	err = addOrUpdateUserTags(context.Background(), store, "1", []string{"webdev"})
+	assert.Nil(t, err)
+
+	var readCount int
+	var score float64
+	err = db.QueryRow("SELECT read_count, score FROM user_tags WHERE user_id = '1' AND tag = 'webdev'").Scan(&readCount, &score)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, readCount)
+	assert.InDelta(t, 3, score, 0.01)
+}
+
+func TestGetUserTagsRankedByScore(t *testing.T) {
+	db := openTestDatabase(t)
+	store := newMySQLTestStore(t, db)
+
+	// A tag read a lot a month ago beats a tag read once today, but not a tag
+	// that was read a lot a year ago
+	_, err := db.Exec("INSERT INTO user_tags (user_id, tag, read_count, score, last_read) VALUES " +
+		"('1', 'once', 1, 1, now()), " +
+		"('1', 'sustained', 50, 50, now() - interval 30 day), " +
+		"('1', 'forgotten', 500, 500, now() - interval 365 day)")
+	assert.Nil(t, err)
+
+	tags, err := store.GetUserTags(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sustained", "once", "forgotten"}, tags)
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/afex/hystrix-go/hystrix"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
-	"os"
 	"path"
 	"regexp"
 	"strconv"
@@ -18,11 +18,27 @@ import (
 
 var httpClient *http.Client
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// parseKeyValues parses a comma separated list of key=value pairs
+func parseKeyValues(value string) map[string]string {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && key != "" && val != "" {
+			res[key] = val
+		}
 	}
-	return fallback
+	return res
+}
+
+// parseList parses a comma separated list, empty items are skipped
+func parseList(value string) []string {
+	res := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
 
 func getJson(req *http.Request, target interface{}) error {
@@ -33,6 +49,10 @@ func getJson(req *http.Request, target interface{}) error {
 
 	defer r.Body.Close()
 
+	if r.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
 	if r.StatusCode == http.StatusOK {
 		return json.NewDecoder(r.Body).Decode(target)
 	} else {
@@ -46,9 +66,9 @@ func getJson(req *http.Request, target interface{}) error {
 }
 
 func getJsonHystrix(breakerName string, req *http.Request, target interface{}, ignoreNotFound bool) error {
-	return hystrix.Do(breakerName,
-		func() error {
-			err := getJson(req, target)
+	return hystrix.DoC(req.Context(), breakerName,
+		func(ctx context.Context) error {
+			err := getJson(req.WithContext(ctx), target)
 			if ignoreNotFound && err != nil && err.Error() == "404" {
 				return nil
 			}
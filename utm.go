@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// UtmTemplate has the templates of the UTM parameters added to the links of
+// the campaigns, {placement}, {campaignId} and {company} are replaced by
+// their values. Empty templates add no parameter.
+type UtmTemplate struct {
+	Source   string `yaml:"source" env:"SOURCE"`
+	Medium   string `yaml:"medium" env:"MEDIUM"`
+	Campaign string `yaml:"campaign" env:"CAMPAIGN"`
+	Content  string `yaml:"content" env:"CONTENT"`
+}
+
+// override returns the template with the parameters of other that are set
+func (t UtmTemplate) override(other UtmTemplate) UtmTemplate {
+	for _, field := range []struct {
+		value    *string
+		override string
+	}{
+		{&t.Source, other.Source},
+		{&t.Medium, other.Medium},
+		{&t.Campaign, other.Campaign},
+		{&t.Content, other.Content},
+	} {
+		if field.override != "" {
+			*field.value = field.override
+		}
+	}
+	return t
+}
+
+// utmDecorator adds the UTM parameters of the placement, overridden by the
+// ones of the campaign, to the links of the campaigns we serve. Links of the
+// other providers are tracking redirects of the provider, so they're left as
+// they are.
+type utmDecorator struct {
+	placements map[string]UtmTemplate
+}
+
+func newUtmDecorator(cfg UtmConfig) *utmDecorator {
+	return &utmDecorator{placements: cfg.Placements}
+}
+
+// decorate appends the parameters the link doesn't have yet, so parameters
+// set by the advertiser are kept
+func (d *utmDecorator) decorate(camp CampaignAd, placement string) string {
+	u, err := url.Parse(camp.Link)
+	if err != nil || u.Host == "" {
+		return camp.Link
+	}
+
+	template := d.placements[placement].override(camp.utm)
+	replacer := strings.NewReplacer("{placement}", placement, "{campaignId}", camp.Id, "{company}", camp.Company)
+	existing := u.Query()
+	var params []string
+	for _, param := range []struct {
+		key      string
+		template string
+	}{
+		{"utm_source", template.Source},
+		{"utm_medium", template.Medium},
+		{"utm_campaign", template.Campaign},
+		{"utm_content", template.Content},
+	} {
+		value := strings.TrimSpace(replacer.Replace(param.template))
+		if value == "" || existing.Has(param.key) {
+			continue
+		}
+		params = append(params, param.key+"="+url.QueryEscape(value))
+	}
+	if len(params) == 0 {
+		return camp.Link
+	}
+
+	// The link is extended as a string to keep the rest of it as it is
+	link, fragment, hasFragment := strings.Cut(camp.Link, "#")
+	switch {
+	case !strings.Contains(link, "?"):
+		link += "?"
+	case !strings.HasSuffix(link, "?") && !strings.HasSuffix(link, "&"):
+		link += "&"
+	}
+	link += strings.Join(params, "&")
+	if hasFragment {
+		link += "#" + fragment
+	}
+	return link
+}
+
+// decorateAds decorates the links of the campaign ads
+func (d *utmDecorator) decorateAds(res []interface{}, placement string) {
+	for i, ad := range res {
+		if camp, ok := ad.(CampaignAd); ok {
+			camp.Link = d.decorate(camp, placement)
+			res[i] = camp
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUtmDecorator(t *testing.T) {
+	utm := newUtmDecorator(UtmConfig{Placements: map[string]UtmTemplate{
+		"feed": {Source: "daily.dev", Medium: "native", Campaign: "{campaignId}", Content: "{placement}"},
+		"post": {Source: "daily.dev", Campaign: "{company} {campaignId}"},
+	}})
+	tests := []struct {
+		name      string
+		link      string
+		placement string
+		utm       UtmTemplate
+		expected  string
+	}{
+		{"adds the parameters", "https://daily.dev/ads", "feed", UtmTemplate{}, "https://daily.dev/ads?utm_source=daily.dev&utm_medium=native&utm_campaign=1&utm_content=feed"},
+		{"keeps the query and fragment", "https://daily.dev/ads?ref=1#top", "post", UtmTemplate{}, "https://daily.dev/ads?ref=1&utm_source=daily.dev&utm_campaign=Acme+1#top"},
+		{"doesn't duplicate parameters", "https://daily.dev/?utm_source=acme&", "post", UtmTemplate{}, "https://daily.dev/?utm_source=acme&utm_campaign=Acme+1"},
+		{"campaign overrides the placement", "https://daily.dev", "feed", UtmTemplate{Medium: "cpc", Content: "banner"}, "https://daily.dev?utm_source=daily.dev&utm_medium=cpc&utm_campaign=1&utm_content=banner"},
+		{"campaign without placement template", "https://daily.dev", "toilet", UtmTemplate{Source: "{placement}"}, "https://daily.dev?utm_source=toilet"},
+		{"nothing to add", "https://daily.dev", "toilet", UtmTemplate{}, "https://daily.dev"},
+		{"leaves invalid links", "link", "feed", UtmTemplate{}, "link"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			camp := CampaignAd{Ad: Ad{Link: test.link, Company: "Acme"}, Id: "1", utm: test.utm}
+			assert.Equal(t, test.expected, utm.decorate(camp, test.placement))
+		})
+	}
+}
+
+func TestUtmDecoratorProviderAds(t *testing.T) {
+	utm := newUtmDecorator(testConfig.Utm)
+	res := []interface{}{BsaAd{Ad: Ad{Link: "https://srv.buysellads.com/click"}}}
+	utm.decorateAds(res, "feed")
+	assert.Equal(t, "https://srv.buysellads.com/click", res[0].(BsaAd).Link, "provider links should be left as they are")
+}